@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/build"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+)
+
+var (
+	buildTags                   []string
+	buildFile                   string
+	buildPlatform               string
+	buildSnapshotter            string
+	buildMaxConcurrentDownloads int
+)
+
+var buildCmd = &cobra.Command{
+	Use:   "build [context]",
+	Short: "Build an image from a Containerfile",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		contextDir, err := filepath.Abs(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to resolve build context '%s': %w", args[0], err)
+		}
+		if info, err := os.Stat(contextDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("build context '%s' is not a directory", args[0])
+		}
+
+		var tags []utiles.Reference
+		for _, tag := range buildTags {
+			ref, err := utiles.ParseReference(tag)
+			if err != nil {
+				return err
+			}
+			if ref.Digest != "" {
+				return fmt.Errorf("cannot tag with a digest reference '%s'", tag)
+			}
+			tags = append(tags, ref)
+		}
+
+		file := buildFile
+		if file == "" {
+			file = filepath.Join(contextDir, "Containerfile")
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				file = filepath.Join(contextDir, "Dockerfile")
+			}
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("failed to open Containerfile '%s': %w", file, err)
+		}
+		instructions, err := build.Parse(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s': %w", file, err)
+		}
+
+		platform, err := platformFromFlag(buildPlatform)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+		snapshotter, err := selectSnapshotter(buildSnapshotter)
+		if err != nil {
+			return err
+		}
+		sourceDateEpoch, err := oci.SourceDateEpoch()
+		if err != nil {
+			return err
+		}
+
+		opts := build.Options{
+			Store:                  store,
+			Snapshotter:            snapshotter,
+			ContextDir:             contextDir,
+			ContainerDir:           "_containers",
+			Platform:               platform,
+			IDMaps:                 run.ContainerIDMappings(os.Getuid(), os.Getgid()),
+			MaxConcurrentDownloads: buildMaxConcurrentDownloads,
+			SourceDateEpoch:        sourceDateEpoch,
+		}
+		desc, err := build.Build(instructions, opts)
+		if err != nil {
+			return fmt.Errorf("build failed: %w", err)
+		}
+
+		if len(tags) == 0 {
+			if err := store.AddImage(desc); err != nil {
+				return err
+			}
+		}
+		for _, tag := range tags {
+			if err := store.Tag(tag, desc); err != nil {
+				return fmt.Errorf("failed to tag image as '%s': %w", tag, err)
+			}
+		}
+		fmt.Printf("Successfully built %s\n", desc.Digest.Encoded()[:12])
+		for _, tag := range tags {
+			fmt.Printf("Successfully tagged %s\n", tag)
+		}
+		return nil
+	},
+}
+
+func init() {
+	buildCmd.Flags().StringArrayVarP(&buildTags, "tag", "t", nil, "Name the built image (can be repeated)")
+	buildCmd.Flags().StringVarP(&buildFile, "file", "f", "", "Path to the Containerfile (default: <context>/Containerfile, then <context>/Dockerfile)")
+	buildCmd.Flags().StringVar(&buildPlatform, "platform", "", "Build for this platform (os/arch[/variant]) instead of the host's")
+	buildCmd.Flags().StringVar(&buildSnapshotter, "snapshotter", "auto", "How RUN steps get their rootfs: overlay, copy, or auto (overlay when supported)")
+	buildCmd.Flags().IntVar(&buildMaxConcurrentDownloads, "max-concurrent-downloads", oci.DefaultMaxConcurrentDownloads, "Maximum number of layers downloaded at once when pulling the base image")
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+)
+
+var (
+	commitAuthor  string
+	commitMessage string
+	commitCmd     string
+	commitEnv     []string
+)
+
+var commitContainerCmd = &cobra.Command{
+	Use:   "commit [containerID] [image]",
+	Short: "Create a new image from a container's filesystem changes",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		containerID := args[0]
+		ref, err := utiles.ParseReference(args[1])
+		if err != nil {
+			return err
+		}
+		if ref.Digest != "" {
+			return fmt.Errorf("cannot tag with a digest reference '%s'", args[1])
+		}
+
+		runConfig, err := readContainerConfig(containerID)
+		if err != nil {
+			return err
+		}
+		manifestDigest, err := containerManifest(containerID, runConfig)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+		sourceDateEpoch, err := oci.SourceDateEpoch()
+		if err != nil {
+			return err
+		}
+
+		opts := oci.CommitOptions{
+			Author:    commitAuthor,
+			Comment:   commitMessage,
+			CreatedBy: strings.Join(runConfig.ProcessConfig.Args, " "),
+			Env:       commitEnv,
+			Layer: oci.LayerOptions{
+				IDMaps:          run.ContainerIDMappings(os.Getuid(), os.Getgid()),
+				SourceDateEpoch: sourceDateEpoch,
+			},
+		}
+		if cmd.Flags().Changed("cmd") {
+			// Like CMD in a Containerfile: a JSON array or a shell command.
+			if err := json.Unmarshal([]byte(commitCmd), &opts.Cmd); err != nil || !strings.HasPrefix(strings.TrimSpace(commitCmd), "[") {
+				opts.Cmd = []string{"/bin/sh", "-c", commitCmd}
+			}
+		}
+
+		changes, root, cleanup, err := containerChanges(store, containerID, runConfig)
+		defer cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to compute changes of container '%s': %w", containerID, err)
+		}
+
+		desc, err := oci.Commit(store, manifestDigest, root, changes, opts)
+		if err != nil {
+			return fmt.Errorf("failed to commit container '%s': %w", containerID, err)
+		}
+		if err := store.Tag(ref, desc); err != nil {
+			return fmt.Errorf("failed to tag image as '%s': %w", ref, err)
+		}
+		fmt.Printf("Committed container %s as %s (%s)\n", containerID, ref, desc.Digest.Encoded()[:12])
+		return nil
+	},
+}
+
+func init() {
+	commitContainerCmd.Flags().StringVarP(&commitAuthor, "author", "a", "", "Author recorded in the image")
+	commitContainerCmd.Flags().StringVarP(&commitMessage, "message", "m", "", "Comment recorded in the image history")
+	commitContainerCmd.Flags().StringVar(&commitCmd, "cmd", "", "Replace the image's CMD (JSON array or shell command)")
+	commitContainerCmd.Flags().StringArrayVarP(&commitEnv, "env", "e", nil, "Set an environment variable in the image (KEY=VALUE, can be repeated)")
+}
@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+func readContainerConfig(containerID string) (*run.ImageConfig, error) {
+	configFilePath := filepath.Join("_containers", containerID, "config.json")
+	configBytes, err := os.ReadFile(configFilePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("container '%s' not found or missing config.json", containerID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container config '%s': %w", configFilePath, err)
+	}
+	var runConfig run.ImageConfig
+	if err := json.Unmarshal(configBytes, &runConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse container config '%s': %w", configFilePath, err)
+	}
+	return &runConfig, nil
+}
+
+// containerChanges lists what a container changed relative to its image,
+// along with the directory holding the new content: the overlay upper
+// directory, or the rootfs in copy mode. In copy mode the image is unpacked
+// next to the rootfs to compare against; the returned cleanup removes it.
+func containerChanges(store *oci.Store, containerID string, runConfig *run.ImageConfig) ([]oci.Change, string, func(), error) {
+	noop := func() {}
+	containerBasePath := filepath.Join("_containers", containerID)
+	if overlay := runConfig.Root.Overlay; overlay != nil {
+		changes, err := oci.OverlayChanges(overlay.UpperDir, overlay.LowerDirs)
+		return changes, overlay.UpperDir, noop, err
+	}
+
+	if runConfig.Image == nil {
+		return nil, "", noop, fmt.Errorf("container '%s' does not record the image it was created from", containerID)
+	}
+	manifest, err := oci.ReadManifest(store.Root, runConfig.Image.Manifest)
+	if err != nil {
+		return nil, "", noop, fmt.Errorf("failed to read image of container '%s': %w", containerID, err)
+	}
+	imageConfig, err := oci.ReadConfig(store.Root, manifest.Config.Digest.String())
+	if err != nil {
+		return nil, "", noop, fmt.Errorf("failed to read image of container '%s': %w", containerID, err)
+	}
+	layers, err := store.ImageLayers(manifest, imageConfig)
+	if err != nil {
+		return nil, "", noop, err
+	}
+
+	baseDir, err := os.MkdirTemp(containerBasePath, ".base-")
+	if err != nil {
+		return nil, "", noop, fmt.Errorf("failed to create comparison directory: %w", err)
+	}
+	cleanup := func() { removeTree(baseDir) }
+	if err := oci.UnpackImageLayers(layers, baseDir, run.ContainerIDMappings(os.Getuid(), os.Getgid())); err != nil {
+		cleanup()
+		return nil, "", noop, fmt.Errorf("failed to unpack image layers: %w", err)
+	}
+	rootfsPath := filepath.Join(containerBasePath, "rootfs")
+	changes, err := oci.TreeChanges(baseDir, rootfsPath)
+	if err != nil {
+		cleanup()
+		return nil, "", noop, err
+	}
+	return changes, rootfsPath, cleanup, nil
+}
+
+// removeTree removes path even when the image made some of its directories
+// read-only.
+func removeTree(path string) {
+	if os.RemoveAll(path) == nil {
+		return
+	}
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(p, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	os.RemoveAll(path)
+}
+
+// containerManifest returns the platform manifest the container was
+// created from.
+func containerManifest(containerID string, runConfig *run.ImageConfig) (digest.Digest, error) {
+	if runConfig.Image == nil {
+		return "", fmt.Errorf("container '%s' does not record the image it was created from", containerID)
+	}
+	dgst, err := digest.Parse(runConfig.Image.Manifest)
+	if err != nil {
+		return "", fmt.Errorf("container '%s' has an invalid image manifest digest: %w", containerID, err)
+	}
+	return dgst, nil
+}
+
+func writeContainerConfig(containerID string, runConfig *run.ImageConfig) error {
+	configFilePath := filepath.Join("_containers", containerID, "config.json")
+	configBytes, err := json.MarshalIndent(runConfig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal runtime config: %w", err)
+	}
+	if err := os.WriteFile(configFilePath, configBytes, 0644); err != nil {
+		return fmt.Errorf("failed to save runtime config to '%s': %w", configFilePath, err)
+	}
+	return nil
+}
+
+// runContainerProcess starts childCmd, inside a cgroup holding the
+// container's resource limits when it has any, waits for it and records how
+// it ended in the container's state. Only failing to start is an error.
+func runContainerProcess(containerID string, runConfig *run.ImageConfig, childCmd *exec.Cmd) (*run.ContainerState, error) {
+	containerBasePath := filepath.Join("_containers", containerID)
+	var cgroup *run.Cgroup
+	if !runConfig.Resources.Empty() {
+		var err error
+		if cgroup, err = run.CreateCgroup(containerID, runConfig.Resources); err != nil {
+			return nil, fmt.Errorf("failed to set up resource limits: %w", err)
+		}
+		defer func() {
+			if err := cgroup.Remove(); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}()
+		closeCgroup, err := cgroup.Apply(childCmd)
+		if err != nil {
+			return nil, err
+		}
+		defer closeCgroup()
+	}
+
+	fmt.Printf("Starting container process (ID: %s)...\n", containerID)
+	if err := childCmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start container process: %w", err)
+	}
+	state := &run.ContainerState{}
+	state.Started(childCmd.Process.Pid)
+	if err := run.WriteState(containerBasePath, state); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	childCmd.Wait()
+
+	oomKills := 0
+	if cgroup != nil {
+		var err error
+		if oomKills, err = cgroup.OOMKills(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	state.Exited(childCmd.ProcessState, oomKills)
+	if err := run.WriteState(containerBasePath, state); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	if state.OOMKilled {
+		fmt.Fprintf(os.Stderr, "warning: container %s ran out of memory: %d process(es) were killed\n", containerID, oomKills)
+	}
+	return state, nil
+}
@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [containerID]",
+	Short: "List the files a container added (A), changed (C) or deleted (D)",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		containerID := args[0]
+		runConfig, err := readContainerConfig(containerID)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+
+		changes, root, cleanup, err := containerChanges(store, containerID, runConfig)
+		defer cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to compute changes of container '%s': %w", containerID, err)
+		}
+		for _, change := range withChangedParents(changes, root) {
+			fmt.Printf("%s %s\n", change.Kind, change.Path)
+		}
+		return nil
+	},
+}
+
+// withChangedParents adds the directories holding changes as changed
+// themselves, like overlayfs does by copying them up, so both snapshotters
+// print the same list.
+func withChangedParents(changes []oci.Change, root string) []oci.Change {
+	listed := make(map[string]bool)
+	for _, change := range changes {
+		listed[change.Path] = true
+	}
+	result := append([]oci.Change(nil), changes...)
+	for _, change := range changes {
+		for dir := path.Dir(change.Path); dir != "/" && !listed[dir]; dir = path.Dir(dir) {
+			if info, err := os.Lstat(filepath.Join(root, dir)); err != nil || !info.IsDir() {
+				break
+			}
+			listed[dir] = true
+			result = append(result, oci.Change{Kind: oci.ChangeModify, Path: dir})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
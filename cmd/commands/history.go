@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/spf13/cobra"
+)
+
+const historyCreatedByWidth = 45
+
+var (
+	historyPlatform string
+	historyNoTrunc  bool
+	historyFormat   string
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history [image]",
+	Short: "Show the build history of an image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		platform, err := platformFromFlag(historyPlatform)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+		desc, _, err := resolveImageArg(store, args[0])
+		if err != nil {
+			return err
+		}
+		manifestDigest, err := store.PlatformManifest(desc, platform)
+		if err != nil {
+			return err
+		}
+		entries, err := oci.ImageHistory(store, manifestDigest)
+		if err != nil {
+			return fmt.Errorf("failed to read history of '%s': %w", args[0], err)
+		}
+
+		// Newest step first, like `docker history`.
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+
+		switch historyFormat {
+		case "json":
+			out, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal history: %w", err)
+			}
+			fmt.Println(string(out))
+			return nil
+		case "table":
+		default:
+			return fmt.Errorf("unknown format '%s' (expected table or json)", historyFormat)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "CREATED\tCREATED BY\tSIZE\tEMPTY LAYER\tCOMMENT")
+		for _, entry := range entries {
+			createdBy := strings.Join(strings.Fields(entry.CreatedBy), " ")
+			if !historyNoTrunc && len(createdBy) > historyCreatedByWidth {
+				createdBy = createdBy[:historyCreatedByWidth-3] + "..."
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", formatCreated(entry.Created), createdBy, oci.FormatBytes(entry.Size), entry.EmptyLayer, entry.Comment)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	historyCmd.Flags().StringVar(&historyPlatform, "platform", "", "Show the history of this platform's variant of a multi-platform image")
+	historyCmd.Flags().BoolVar(&historyNoTrunc, "no-trunc", false, "Don't truncate the CREATED BY column")
+	historyCmd.Flags().StringVar(&historyFormat, "format", "table", "Output format: table or json")
+}
+
+func formatCreated(created string) string {
+	if created == "" {
+		return "<missing>"
+	}
+	t, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return created
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/spf13/cobra"
+)
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Manage images",
+}
+
+var imageVerifyCmd = &cobra.Command{
+	Use:   "verify [image...]",
+	Short: "Re-check the digests of every blob of stored images",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+
+		var finalErr error
+		for _, imageName := range args {
+			desc, _, err := resolveImageArg(store, imageName)
+			if err != nil {
+				fmt.Printf("Error verifying image %s: %v\n", imageName, err)
+				if finalErr == nil {
+					finalErr = fmt.Errorf("image verification failed")
+				}
+				continue
+			}
+
+			fmt.Printf("Verifying image %s (%s)...\n", imageName, desc.Digest)
+			if err := oci.VerifyImage(store, desc, os.Stdout); err != nil {
+				fmt.Printf("Image %s failed verification: %v\n", imageName, err)
+				if finalErr == nil {
+					finalErr = fmt.Errorf("image verification failed")
+				}
+				continue
+			}
+			fmt.Printf("Image %s verified successfully.\n", imageName)
+		}
+		return finalErr
+	},
+}
+
+var imageInspectPlatform string
+
+var imageInspectCmd = &cobra.Command{
+	Use:   "inspect [image...]",
+	Short: "Show the manifest, config, platform, layers and labels of images as JSON",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		platform, err := platformFromFlag(imageInspectPlatform)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+
+		var inspects []*oci.ImageInspect
+		for _, imageName := range args {
+			desc, _, err := resolveImageArg(store, imageName)
+			if err != nil {
+				return err
+			}
+			inspect, err := oci.InspectImage(store, desc, platform)
+			if err != nil {
+				return fmt.Errorf("failed to inspect image '%s': %w", imageName, err)
+			}
+			inspects = append(inspects, inspect)
+		}
+
+		out, err := json.MarshalIndent(inspects, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal image details: %w", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	},
+}
+
+var imagePruneAll bool
+
+var imagePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove untagged images and unreferenced blobs and snapshots",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+		usage, err := containerImageUsage()
+		if err != nil {
+			return err
+		}
+
+		result, err := store.Prune(usage.inUse(), imagePruneAll)
+		if err != nil {
+			return fmt.Errorf("failed to prune images: %w", err)
+		}
+		for _, desc := range result.Images {
+			if name := desc.Annotations[specs.AnnotationRefName]; name != "" {
+				fmt.Printf("Untagged: %s\n", name)
+			}
+			fmt.Printf("Deleted: %s\n", desc.Digest)
+		}
+		reclaimed := result.SpaceReclaimed
+
+		keys, err := store.LayerKeys()
+		if err != nil {
+			return err
+		}
+		for _, userXattr := range []bool{false, true} {
+			snapshotter := &oci.Snapshotter{Root: snapshotRoot(userXattr), UserXattr: userXattr}
+			n, err := snapshotter.Prune(keys, usage.lowerDirs)
+			reclaimed += n
+			if err != nil {
+				return fmt.Errorf("failed to prune snapshots: %w", err)
+			}
+		}
+
+		fmt.Printf("Deleted %d images and %d blobs, reclaimed %d bytes\n", len(result.Images), len(result.Blobs), reclaimed)
+		return nil
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imageVerifyCmd)
+	imageCmd.AddCommand(imagePruneCmd)
+	imageCmd.AddCommand(imageInspectCmd)
+	imageInspectCmd.Flags().StringVar(&imageInspectPlatform, "platform", "", "Inspect this platform's variant of a multi-platform image")
+	imagePruneCmd.Flags().BoolVarP(&imagePruneAll, "all", "a", false, "Also remove tagged images no container was created from")
+}
@@ -0,0 +1,120 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+)
+
+const imageStoreDir = "_images"
+
+func openImageStore() (*oci.Store, error) {
+	return oci.OpenStore(imageStoreDir)
+}
+
+func platformFromFlag(value string) (specs.Platform, error) {
+	if value == "" {
+		return oci.HostPlatform(), nil
+	}
+	return oci.ParsePlatform(value)
+}
+
+func imageAvailableLocally(store *oci.Store, ref utiles.Reference, platform specs.Platform) bool {
+	manifestDigest, err := store.ResolveManifest(ref, platform)
+	if err != nil {
+		return false
+	}
+	manifest, err := oci.ReadManifest(store.Root, manifestDigest.String())
+	if err != nil {
+		return false
+	}
+	if !store.HasBlob(manifest.Config.Digest) {
+		return false
+	}
+	for _, layer := range manifest.Layers {
+		if !store.HasBlob(layer.Digest) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageUsage describes what existing containers still need from the image
+// store: the images they were created from and the snapshots their overlay
+// rootfs is stacked on.
+type imageUsage struct {
+	containers map[digest.Digest][]string
+	lowerDirs  map[string]bool
+}
+
+func (u imageUsage) inUse() map[digest.Digest]bool {
+	inUse := make(map[digest.Digest]bool)
+	for dgst := range u.containers {
+		inUse[dgst] = true
+	}
+	return inUse
+}
+
+func containerImageUsage() (imageUsage, error) {
+	usage := imageUsage{containers: make(map[digest.Digest][]string), lowerDirs: make(map[string]bool)}
+	entries, err := os.ReadDir("_containers")
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return usage, fmt.Errorf("failed to read container directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		configFilePath := filepath.Join("_containers", entry.Name(), "config.json")
+		configBytes, err := os.ReadFile(configFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping container %s: %v\n", entry.Name(), err)
+			continue
+		}
+		var runConfig run.ImageConfig
+		if err := json.Unmarshal(configBytes, &runConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping container %s: failed to parse '%s': %v\n", entry.Name(), configFilePath, err)
+			continue
+		}
+		if runConfig.Image != nil {
+			dgst := digest.Digest(runConfig.Image.Digest)
+			usage.containers[dgst] = append(usage.containers[dgst], entry.Name())
+		}
+		if runConfig.Root.Overlay != nil {
+			for _, dir := range runConfig.Root.Overlay.LowerDirs {
+				usage.lowerDirs[dir] = true
+			}
+		}
+	}
+	return usage, nil
+}
+
+// resolveImageArg finds an image by reference or, failing that, by (a prefix
+// of) its ID as shown by `list --images`. ref is the zero Reference when the
+// image was found by ID.
+func resolveImageArg(store *oci.Store, arg string) (specs.Descriptor, utiles.Reference, error) {
+	ref, refErr := utiles.ParseReference(arg)
+	if refErr == nil {
+		if desc, err := store.Resolve(ref); err == nil {
+			return desc, ref, nil
+		}
+	}
+	desc, err := store.ResolveID(arg)
+	if err != nil {
+		if refErr != nil {
+			return specs.Descriptor{}, utiles.Reference{}, refErr
+		}
+		return specs.Descriptor{}, utiles.Reference{}, fmt.Errorf("image '%s' not found in local store", arg)
+	}
+	return desc, utiles.Reference{}, nil
+}
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+type containerInspect struct {
+	ID     string              `json:"Id"`
+	State  *run.ContainerState `json:"State"`
+	Config *run.ImageConfig    `json:"Config"`
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [containerID...]",
+	Short: "Show the configuration and state of containers as JSON",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var results []containerInspect
+		for _, containerID := range args {
+			runConfig, err := readContainerConfig(containerID)
+			if err != nil {
+				return err
+			}
+			state, err := run.ReadState(filepath.Join("_containers", containerID))
+			if err != nil {
+				return err
+			}
+			results = append(results, containerInspect{ID: containerID, State: state, Config: runConfig})
+		}
+		out, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal container details: %w", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	},
+}
@@ -3,8 +3,11 @@ package commands
 import (
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
+	"text/tabwriter"
 
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
 	"github.com/spf13/cobra"
 )
 
@@ -15,7 +18,7 @@ var listCmd = &cobra.Command{
 	Short: "List containers or images",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if listImagesFlag {
-			images := ListImages("_images")
+			images := ListImages(imageStoreDir)
 			if images == nil {
 				fmt.Println("No images found or error listing images.")
 				return nil
@@ -30,10 +33,19 @@ var listCmd = &cobra.Command{
 				fmt.Println("No containers found or error listing containers.")
 				return nil
 			}
-			fmt.Println("CONTAINER IDS:")
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tSTATUS")
 			for _, id := range containers {
-				fmt.Println(id)
+				image, status := "", ""
+				if runConfig, err := readContainerConfig(id); err == nil && runConfig.Image != nil {
+					image = runConfig.Image.Name
+				}
+				if state, err := run.ReadState(filepath.Join("_containers", id)); err == nil {
+					status = state.Describe()
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", id, image, status)
 			}
+			w.Flush()
 		}
 		return nil
 	},
@@ -59,22 +71,23 @@ func ListContainers(containerdir string) []string {
 }
 
 func ListImages(imagedir string) []string {
-	entries, err := os.ReadDir(imagedir)
+	store, err := oci.OpenStore(imagedir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading image directory %s: %v\n", imagedir, err)
+		fmt.Fprintf(os.Stderr, "Error opening image store %s: %v\n", imagedir, err)
+		return nil
+	}
+	images, err := store.Images()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading image store %s: %v\n", imagedir, err)
 		return nil
 	}
 	var imageNames []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			parts := strings.SplitN(entry.Name(), "_", 2)
-			if len(parts) == 2 {
-				imageName := fmt.Sprintf("%s:%s", parts[0], parts[1])
-				imageNames = append(imageNames, imageName)
-			} else {
-				imageNames = append(imageNames, entry.Name()+" (malformed?)")
-			}
+	for _, img := range images {
+		name := img.Ref.String()
+		if img.Untagged() {
+			name = "<none>"
 		}
+		imageNames = append(imageNames, fmt.Sprintf("%-60s %s", name, img.Descriptor.Digest.Encoded()[:12]))
 	}
 	return imageNames
 }
@@ -0,0 +1,49 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/spf13/cobra"
+)
+
+var loadInput string
+
+var loadCmd = &cobra.Command{
+	Use:   "load",
+	Short: "Load images from a docker-archive or OCI-archive tarball",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var input io.Reader = os.Stdin
+		if loadInput != "" && loadInput != "-" {
+			f, err := os.Open(loadInput)
+			if err != nil {
+				return fmt.Errorf("failed to open archive '%s': %w", loadInput, err)
+			}
+			defer f.Close()
+			input = f
+		}
+
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+		refs, err := oci.LoadArchive(store, input)
+		if err != nil {
+			return fmt.Errorf("failed to load images: %w", err)
+		}
+		if len(refs) == 0 {
+			return fmt.Errorf("archive contains no named images")
+		}
+		for _, ref := range refs {
+			fmt.Printf("Loaded image: %s\n", ref)
+		}
+		return nil
+	},
+}
+
+func init() {
+	loadCmd.Flags().StringVarP(&loadInput, "input", "i", "", "Read the archive from this file instead of stdin")
+}
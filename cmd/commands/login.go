@@ -0,0 +1,138 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var (
+	loginUsername      string
+	loginPassword      string
+	loginPasswordStdin bool
+)
+
+var loginCmd = &cobra.Command{
+	Use:   "login [server]",
+	Short: "Log in to a container registry",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		server := oci.DockerHubHost
+		if len(args) == 1 {
+			server = normalizeRegistryServer(args[0])
+		}
+
+		username := loginUsername
+		if username == "" {
+			if loginPasswordStdin {
+				return fmt.Errorf("--username is required when using --password-stdin")
+			}
+			fmt.Print("Username: ")
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read username: %w", err)
+			}
+			username = strings.TrimSpace(line)
+		}
+		if username == "" {
+			return fmt.Errorf("username is required")
+		}
+
+		password := loginPassword
+		if loginPasswordStdin {
+			if password != "" {
+				return fmt.Errorf("--password and --password-stdin are mutually exclusive")
+			}
+			passwordBytes, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return fmt.Errorf("failed to read password from stdin: %w", err)
+			}
+			password = strings.TrimRight(string(passwordBytes), "\r\n")
+		}
+		if password == "" && !loginPasswordStdin && term.IsTerminal(int(os.Stdin.Fd())) {
+			fmt.Print("Password: ")
+			passwordBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Println()
+			if err != nil {
+				return fmt.Errorf("failed to read password: %w", err)
+			}
+			password = string(passwordBytes)
+		}
+		if password == "" {
+			return fmt.Errorf("password is required: use --password or --password-stdin")
+		}
+
+		creds := oci.Credentials{Username: username, Password: password}
+		client := oci.NewRegistryClient(server)
+		client.Credentials = &creds
+		if err := client.Ping(); err != nil {
+			return fmt.Errorf("login to '%s' failed: %w", server, err)
+		}
+
+		storePath, err := oci.DefaultCredentialsPath()
+		if err != nil {
+			return err
+		}
+		store, err := oci.LoadCredentialStore(storePath)
+		if err != nil {
+			return err
+		}
+		store.Set(server, creds)
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Login succeeded for '%s' (credentials saved to %s)\n", server, storePath)
+		return nil
+	},
+}
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout [server]",
+	Short: "Log out from a container registry",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		server := oci.DockerHubHost
+		if len(args) == 1 {
+			server = normalizeRegistryServer(args[0])
+		}
+
+		storePath, err := oci.DefaultCredentialsPath()
+		if err != nil {
+			return err
+		}
+		store, err := oci.LoadCredentialStore(storePath)
+		if err != nil {
+			return err
+		}
+		if !store.Remove(server) {
+			fmt.Printf("Not logged in to '%s'\n", server)
+			return nil
+		}
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed login credentials for '%s'\n", server)
+		return nil
+	},
+}
+
+func init() {
+	loginCmd.Flags().StringVarP(&loginUsername, "username", "u", "", "Registry username")
+	loginCmd.Flags().StringVarP(&loginPassword, "password", "p", "", "Registry password or token")
+	loginCmd.Flags().BoolVar(&loginPasswordStdin, "password-stdin", false, "Read the password from stdin")
+}
+
+func normalizeRegistryServer(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server, _, _ = strings.Cut(server, "/")
+	return server
+}
@@ -2,14 +2,17 @@ package commands
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
 	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
 	"github.com/spf13/cobra"
 )
 
+var (
+	pullPlatform               string
+	pullMaxConcurrentDownloads int
+)
+
 var pullCmd = &cobra.Command{
 	Use:   "pull [image]",
 	Short: "Pull an image from a registry",
@@ -17,25 +20,36 @@ var pullCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		imageName := args[0]
 
-		imgBase, imgTag := utiles.ParseImageName(imageName)
-		normalizedImageName := fmt.Sprintf("%s_%s", imgBase, imgTag)
-		imageStorePath := filepath.Join("_images", normalizedImageName)
+		ref, err := utiles.ParseReference(imageName)
+		if err != nil {
+			return err
+		}
+		platform, err := platformFromFlag(pullPlatform)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
 
-		if _, err := os.Stat(imageStorePath); err == nil {
-			fmt.Printf("Image '%s' already exists locally at %s. Skipping pull.\n", imageName, imageStorePath)
+		if imageAvailableLocally(store, ref, platform) {
+			fmt.Printf("Image '%s' (%s) already exists locally. Skipping pull.\n", ref, oci.FormatPlatform(platform))
 			return nil
-		} else if !os.IsNotExist(err) {
-			return fmt.Errorf("failed to check image directory '%s': %w", imageStorePath, err)
 		}
 
-		fmt.Printf("Pulling image '%s'...\n", imageName)
-		_, err := oci.PullImage(imageStorePath, imageName)
-		if err != nil {
-			os.RemoveAll(imageStorePath)
+		fmt.Printf("Pulling image '%s'...\n", ref)
+		pullOpts := oci.PullOptions{Platform: platform, MaxConcurrentDownloads: pullMaxConcurrentDownloads}
+		if _, err := oci.PullImage(store, ref, pullOpts); err != nil {
 			return fmt.Errorf("failed to pull image '%s': %w", imageName, err)
 		}
 
-		fmt.Printf("Successfully pulled image '%s' to %s\n", imageName, imageStorePath)
+		fmt.Printf("Successfully pulled image '%s'\n", ref)
 		return nil
 	},
 }
+
+func init() {
+	pullCmd.Flags().StringVar(&pullPlatform, "platform", "", "Pull the image for this platform (os/arch[/variant]) instead of the host's")
+	pullCmd.Flags().IntVar(&pullMaxConcurrentDownloads, "max-concurrent-downloads", oci.DefaultMaxConcurrentDownloads, "Maximum number of layers downloaded at once")
+}
@@ -8,4 +8,16 @@ func RegisterCommands(root *cobra.Command) {
 	root.AddCommand(listCmd)
 	root.AddCommand(pullCmd)
 	root.AddCommand(startCmd) // Add the start command
+	root.AddCommand(loginCmd)
+	root.AddCommand(logoutCmd)
+	root.AddCommand(imageCmd)
+	root.AddCommand(loadCmd)
+	root.AddCommand(saveCmd)
+	root.AddCommand(rmiCmd)
+	root.AddCommand(tagCmd)
+	root.AddCommand(historyCmd)
+	root.AddCommand(buildCmd)
+	root.AddCommand(commitContainerCmd)
+	root.AddCommand(diffCmd)
+	root.AddCommand(inspectCmd)
 }
@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+type resourceFlags struct {
+	memory      string
+	memorySwap  string
+	cpus        float64
+	cpuShares   uint64
+	pidsLimit   int64
+	blkioWeight uint16
+}
+
+func addResourceFlags(cmd *cobra.Command, f *resourceFlags) {
+	cmd.Flags().StringVarP(&f.memory, "memory", "m", "", "Memory limit (e.g. 512m, 2g)")
+	cmd.Flags().StringVar(&f.memorySwap, "memory-swap", "", "Limit of memory plus swap (e.g. 1g), -1 for unlimited swap")
+	cmd.Flags().Float64Var(&f.cpus, "cpus", 0, "Number of CPUs the container may use (e.g. 1.5)")
+	cmd.Flags().Uint64Var(&f.cpuShares, "cpu-shares", 0, "Relative CPU weight (2-262144, default weight is 1024)")
+	cmd.Flags().Int64Var(&f.pidsLimit, "pids-limit", 0, "Maximum number of processes, -1 for unlimited")
+	cmd.Flags().Uint16Var(&f.blkioWeight, "blkio-weight", 0, "Relative block IO weight (10-1000)")
+}
+
+func resourceFlagsChanged(cmd *cobra.Command) bool {
+	for _, name := range []string{"memory", "memory-swap", "cpus", "cpu-shares", "pids-limit", "blkio-weight"} {
+		if cmd.Flags().Changed(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resources returns base (the limits a container already has, if any) with
+// the limits given on the command line applied, or nil when none are set.
+func (f *resourceFlags) resources(cmd *cobra.Command, base *run.ResourcesConfig) (*run.ResourcesConfig, error) {
+	res := run.ResourcesConfig{}
+	if base != nil {
+		res = *base
+	}
+	flags := cmd.Flags()
+	if flags.Changed("memory") {
+		memory, err := parseBytes(f.memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --memory: %w", err)
+		}
+		res.Memory = memory
+	}
+	if flags.Changed("memory-swap") {
+		if f.memorySwap == "-1" {
+			res.MemorySwap = -1
+		} else {
+			swap, err := parseBytes(f.memorySwap)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --memory-swap: %w", err)
+			}
+			res.MemorySwap = swap
+		}
+	}
+	if flags.Changed("cpus") {
+		res.CPUs = f.cpus
+	}
+	if flags.Changed("cpu-shares") {
+		res.CPUShares = f.cpuShares
+	}
+	if flags.Changed("pids-limit") {
+		res.PidsLimit = f.pidsLimit
+	}
+	if flags.Changed("blkio-weight") {
+		res.BlkioWeight = f.blkioWeight
+	}
+
+	if res.Empty() {
+		return nil, nil
+	}
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// parseBytes parses sizes such as "512m" or "2GB" in binary units, like
+// Docker's --memory.
+func parseBytes(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			value = value[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+	"github.com/spf13/cobra"
+)
+
+var rmiForce bool
+
+var rmiCmd = &cobra.Command{
+	Use:   "rmi [image...]",
+	Short: "Remove one or more images",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+		usage, err := containerImageUsage()
+		if err != nil {
+			return err
+		}
+
+		var finalErr error
+		for _, imageName := range args {
+			if err := removeImage(store, usage, imageName); err != nil {
+				fmt.Printf("Error removing image %s: %v\n", imageName, err)
+				if finalErr == nil {
+					finalErr = fmt.Errorf("failed to remove image(s)")
+				}
+			}
+		}
+		return finalErr
+	},
+}
+
+func init() {
+	rmiCmd.Flags().BoolVarP(&rmiForce, "force", "f", false, "Remove the image even if containers were created from it or it has several tags")
+}
+
+// removeImage untags imageName and deletes the image once nothing refers to
+// it any more. An image still used by containers is only untagged, and only
+// with --force; it stays in the store until `image prune` finds it unused.
+func removeImage(store *oci.Store, usage imageUsage, imageName string) error {
+	desc, ref, err := resolveImageArg(store, imageName)
+	if err != nil {
+		return err
+	}
+	tags, err := store.TagsOf(desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	byID := ref.Repository == ""
+	if byID && len(tags) > 1 && !rmiForce {
+		return fmt.Errorf("image %s is tagged in %d repositories, remove them by name or use --force", desc.Digest.Encoded()[:12], len(tags))
+	}
+	lastTag := byID || len(tags) <= 1
+	if containers := usage.containers[desc.Digest]; lastTag && len(containers) > 0 && !rmiForce {
+		return fmt.Errorf("image is used by container(s) %s, remove them first or use --force", strings.Join(containers, ", "))
+	}
+
+	untag := tags
+	if !byID {
+		untag = []utiles.Reference{ref}
+	}
+	for _, t := range untag {
+		if _, err := store.Untag(t); err != nil {
+			return err
+		}
+		fmt.Printf("Untagged: %s\n", t)
+	}
+	if !lastTag {
+		return nil
+	}
+
+	if containers := usage.containers[desc.Digest]; len(containers) > 0 {
+		fmt.Printf("Image %s is kept untagged for container(s) %s\n", desc.Digest.Encoded()[:12], strings.Join(containers, ", "))
+		return nil
+	}
+	removed, err := store.DeleteImage(desc.Digest)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted: %s\n", desc.Digest)
+	if len(removed) > 0 {
+		fmt.Printf("Deleted %d blobs\n", len(removed))
+	}
+	return nil
+}
@@ -6,10 +6,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"runtime"
 	"syscall"
 
 	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
 	"github.com/spf13/cobra"
 
 	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
@@ -17,6 +18,17 @@ import (
 	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
 )
 
+var (
+	runPlatform               string
+	runSnapshotter            string
+	runMaxConcurrentDownloads int
+	runResources              resourceFlags
+	runCapAdd                 []string
+	runCapDrop                []string
+	runSecurityOpts           []string
+	runUser                   string
+)
+
 var runCmd = &cobra.Command{
 	Use:   "run [image] [command...]",
 	Short: "Run a command in a new container",
@@ -25,19 +37,49 @@ var runCmd = &cobra.Command{
 		imageName := args[0]
 		containerCmd := args[1:]
 
-		imgBase, imgTag := utiles.ParseImageName(imageName)
-		normalizedImageName := fmt.Sprintf("%s_%s", imgBase, imgTag)
-		imageStorePath := filepath.Join("_images", normalizedImageName)
+		ref, err := utiles.ParseReference(imageName)
+		if err != nil {
+			return err
+		}
+		platform, err := platformFromFlag(runPlatform)
+		if err != nil {
+			return err
+		}
+		resources, err := runResources.resources(cmd, nil)
+		if err != nil {
+			return err
+		}
+		capabilities, err := run.ContainerCapabilities(runCapAdd, runCapDrop)
+		if err != nil {
+			return err
+		}
+		securityOpts, err := parseSecurityOpts(runSecurityOpts)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+
+		snapshotter, err := selectSnapshotter(runSnapshotter)
+		if err != nil {
+			return err
+		}
 
-		if _, err := os.Stat(imageStorePath); os.IsNotExist(err) {
+		if !imageAvailableLocally(store, ref, platform) {
 			fmt.Printf("Image '%s' not found locally, pulling...\n", imageName)
-			_, err := oci.PullImage(imageStorePath, imageName)
-			if err != nil {
+			pullOpts := oci.PullOptions{
+				Platform:               platform,
+				MaxConcurrentDownloads: runMaxConcurrentDownloads,
+				Snapshotter:            snapshotter,
+			}
+			if _, err := oci.PullImage(store, ref, pullOpts); err != nil {
 				return fmt.Errorf("failed to pull image '%s': %w", imageName, err)
 			}
 			fmt.Printf("Image '%s' pulled successfully.\n", imageName)
 		} else {
-			fmt.Printf("Using local image '%s' from %s\n", imageName, imageStorePath)
+			fmt.Printf("Using local image '%s'\n", ref)
 		}
 
 		containerID := uuid.New().String()[:8]
@@ -50,62 +92,54 @@ var runCmd = &cobra.Command{
 			return fmt.Errorf("failed to create container directory '%s': %w", containerBasePath, err)
 		}
 
-		manifestDigest, err := oci.GetImageManifestDigest(imageStorePath)
+		imageDesc, err := store.Resolve(ref)
+		if err != nil {
+			os.RemoveAll(containerBasePath)
+			return fmt.Errorf("failed to resolve image '%s': %w", imageName, err)
+		}
+		manifestDigest, err := store.ResolveManifest(ref, platform)
 		if err != nil {
 			os.RemoveAll(containerBasePath)
 			return fmt.Errorf("failed to get manifest digest for image '%s': %w", imageName, err)
 		}
 
-		isDockerFormat := strings.HasSuffix(manifestDigest, ".json") && !strings.Contains(manifestDigest, "/")
-		fmt.Printf("DEBUG: Detected format identifier: %s (Docker=%v)\n", manifestDigest, isDockerFormat)
-
-		manifest, err := oci.ReadManifest(imageStorePath, manifestDigest)
+		manifest, err := oci.ReadManifest(store.Root, manifestDigest.String())
 		if err != nil {
 			os.RemoveAll(containerBasePath)
 			return fmt.Errorf("failed to read manifest for image '%s': %w", imageName, err)
 		}
-		ociConfig, err := oci.ReadConfig(imageStorePath, manifestDigest)
+		ociConfig, err := oci.ReadConfig(store.Root, manifest.Config.Digest.String())
 		if err != nil {
 			os.RemoveAll(containerBasePath)
 			return fmt.Errorf("failed to read config for image '%s': %w", imageName, err)
 		}
 
-		layerPaths := make([]string, len(manifest.Layers))
+		if len(ociConfig.RootFS.DiffIDs) != len(manifest.Layers) {
+			os.RemoveAll(containerBasePath)
+			return fmt.Errorf("image '%s' config lists %d diff_ids but manifest has %d layers", imageName, len(ociConfig.RootFS.DiffIDs), len(manifest.Layers))
+		}
+
+		layers := make([]oci.Layer, len(manifest.Layers))
 		fmt.Printf("DEBUG: Processing %d layers...\n", len(manifest.Layers))
 		for i, layer := range manifest.Layers {
-			layerDigestStr := layer.Digest.String()
-			fmt.Printf("DEBUG: Layer %d: Digest=%s\n", i, layerDigestStr)
-
-			layerID := oci.DigestToFilename(layerDigestStr)
-
-			dockerLayerPath := filepath.Join(imageStorePath, layerID, "layer.tar")
-			if _, err := os.Stat(dockerLayerPath); err == nil {
-				fmt.Printf("DEBUG: Layer %d: Using Docker format path at %s\n", i, dockerLayerPath)
-				layerPaths[i] = dockerLayerPath
-				continue
+			fmt.Printf("DEBUG: Layer %d: Digest=%s\n", i, layer.Digest)
+			if !store.HasBlob(layer.Digest) {
+				os.RemoveAll(containerBasePath)
+				return fmt.Errorf("layer blob %s not found in image store", layer.Digest)
 			}
-
-			dockerLayerTarPath := filepath.Join(imageStorePath, layerID+".tar")
-			if _, err := os.Stat(dockerLayerTarPath); err == nil {
-				fmt.Printf("DEBUG: Layer %d: Using Docker format .tar path at %s\n", i, dockerLayerTarPath)
-				layerPaths[i] = dockerLayerTarPath
-				continue
+			layers[i] = oci.Layer{
+				Path:      store.BlobPath(layer.Digest),
+				MediaType: layer.MediaType,
+				Digest:    layer.Digest,
+				Size:      layer.Size,
+				DiffID:    digest.Digest(ociConfig.RootFS.DiffIDs[i]),
 			}
-
-			ociLayerPath := filepath.Join(imageStorePath, "blobs", "sha256", layerID)
-			if _, err := os.Stat(ociLayerPath); err == nil {
-				fmt.Printf("DEBUG: Layer %d: Using OCI format path at %s\n", i, ociLayerPath)
-				layerPaths[i] = ociLayerPath
-				continue
-			}
-
-			os.RemoveAll(containerBasePath)
-			return fmt.Errorf("layer not found for digest %s at any expected location", layerDigestStr)
 		}
 
-		if err := oci.UnpackImageLayers(layerPaths, rootfsPath); err != nil {
+		overlay, err := prepareRootfs(snapshotter, layers, containerBasePath, rootfsPath)
+		if err != nil {
 			os.RemoveAll(containerBasePath)
-			return fmt.Errorf("failed to unpack layers for container '%s': %w", containerID, err)
+			return fmt.Errorf("failed to prepare rootfs for container '%s': %w", containerID, err)
 		}
 
 		runConfig, err := oci.MapOciConfigToRunConfig(ociConfig, rootfsPath)
@@ -113,6 +147,14 @@ var runCmd = &cobra.Command{
 			os.RemoveAll(containerBasePath)
 			return fmt.Errorf("failed to map OCI config for container '%s': %w", containerID, err)
 		}
+		runConfig.Root.Overlay = overlay
+		runConfig.Image = &run.ImageRef{Name: ref.String(), Digest: imageDesc.Digest.String(), Manifest: manifestDigest.String()}
+		runConfig.Resources = resources
+		runConfig.ProcessConfig.Capabilities = capabilities
+		securityOpts.apply(runConfig)
+		if cmd.Flags().Changed("user") {
+			runConfig.ProcessConfig.User = run.User{Username: runUser}
+		}
 
 		if len(containerCmd) > 0 {
 			runConfig.ProcessConfig.Args = containerCmd
@@ -139,16 +181,14 @@ var runCmd = &cobra.Command{
 		hostGID := os.Getgid()
 		run.ApplyNamespaces(childCmd, hostUID, hostGID)
 
-		fmt.Printf("Starting container process (ID: %s)...\n", containerID)
-		if err := childCmd.Start(); err != nil {
+		state, err := runContainerProcess(containerID, runConfig, childCmd)
+		if err != nil {
 			os.RemoveAll(containerBasePath)
-			return fmt.Errorf("failed to start container process: %w", err)
+			return err
 		}
 
-		err = childCmd.Wait()
-
-		if err != nil {
-			fmt.Printf("Container process exited with error: %v\n", err)
+		if state.ExitCode != 0 {
+			fmt.Printf("Container process exited with error: %s\n", state.Describe())
 		} else {
 			fmt.Printf("Container %s finished successfully.\n", containerID)
 		}
@@ -157,12 +197,123 @@ var runCmd = &cobra.Command{
 	},
 }
 
+func init() {
+	runCmd.Flags().SetInterspersed(false)
+	runCmd.Flags().StringVar(&runPlatform, "platform", "", "Run the image variant for this platform (os/arch[/variant])")
+	addResourceFlags(runCmd, &runResources)
+	runCmd.Flags().StringSliceVar(&runCapAdd, "cap-add", nil, "Add Linux capabilities to the default set (e.g. NET_ADMIN, or ALL)")
+	runCmd.Flags().StringSliceVar(&runCapDrop, "cap-drop", nil, "Drop Linux capabilities from the default set (e.g. NET_RAW, or ALL)")
+	runCmd.Flags().StringVarP(&runUser, "user", "u", "", "Run as this user: name or uid, optionally with :group or :gid")
+	runCmd.Flags().StringArrayVar(&runSecurityOpts, "security-opt", nil, "Security options: seccomp=<profile.json>, seccomp=unconfined, no-new-privileges[=false]")
+	runCmd.Flags().StringVar(&runSnapshotter, "snapshotter", "auto", "How to build the rootfs: overlay, copy, or auto (overlay when supported)")
+	runCmd.Flags().IntVar(&runMaxConcurrentDownloads, "max-concurrent-downloads", oci.DefaultMaxConcurrentDownloads, "Maximum number of layers downloaded at once when pulling")
+}
+
+// selectSnapshotter returns the snapshotter the container's rootfs will be
+// built from, or nil for copy mode. In auto mode overlay is used when a probe
+// mount inside the container's namespaces succeeds.
+func selectSnapshotter(mode string) (*oci.Snapshotter, error) {
+	switch mode {
+	case "overlay", "auto":
+	case "copy":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown snapshotter '%s' (expected overlay, copy or auto)", mode)
+	}
+
+	// Without real root the overlay is mounted inside the container's user
+	// namespace, where the kernel only allows user.* xattrs.
+	userXattr := os.Geteuid() != 0
+	snapshotter, err := oci.NewSnapshotter(snapshotRoot(userXattr), userXattr, run.ContainerIDMappings(os.Getuid(), os.Getgid()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := run.OverlaySupported(snapshotter.Root, userXattr, os.Getuid(), os.Getgid()); err != nil {
+		if mode == "overlay" {
+			return nil, err
+		}
+		fmt.Printf("Overlay rootfs unavailable (%v), falling back to copying layers.\n", err)
+		return nil, nil
+	}
+	return snapshotter, nil
+}
+
+func snapshotRoot(userXattr bool) string {
+	if userXattr {
+		return filepath.Join(imageStoreDir, "snapshots-rootless")
+	}
+	return filepath.Join(imageStoreDir, "snapshots")
+}
+
+// prepareRootfs builds the container rootfs. With a snapshotter the image
+// layers are extracted once into shared snapshots and the returned config
+// tells the child how to mount them; in copy mode every layer is unpacked
+// into rootfsPath and nil is returned.
+func prepareRootfs(snapshotter *oci.Snapshotter, layers []oci.Layer, containerBasePath, rootfsPath string) (*run.OverlayConfig, error) {
+	if snapshotter != nil {
+		overlay, err := prepareOverlayRootfs(snapshotter, layers, containerBasePath, rootfsPath)
+		if err == nil {
+			return overlay, nil
+		}
+		if runSnapshotter == "overlay" {
+			return nil, err
+		}
+		fmt.Printf("Overlay rootfs unavailable (%v), falling back to copying layers.\n", err)
+		os.RemoveAll(filepath.Join(containerBasePath, "upper"))
+		os.RemoveAll(filepath.Join(containerBasePath, "work"))
+	}
+
+	if err := oci.UnpackImageLayers(layers, rootfsPath, run.ContainerIDMappings(os.Getuid(), os.Getgid())); err != nil {
+		return nil, fmt.Errorf("failed to unpack layers: %w", err)
+	}
+	return nil, nil
+}
+
+func prepareOverlayRootfs(snapshotter *oci.Snapshotter, layers []oci.Layer, containerBasePath, rootfsPath string) (*run.OverlayConfig, error) {
+	lowerDirs, err := snapshotter.Prepare(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	overlay := &run.OverlayConfig{UserXattr: snapshotter.UserXattr}
+	for _, dir := range lowerDirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve snapshot path '%s': %w", dir, err)
+		}
+		overlay.LowerDirs = append(overlay.LowerDirs, absDir)
+	}
+	upperDir := filepath.Join(containerBasePath, "upper")
+	workDir := filepath.Join(containerBasePath, "work")
+	for _, dir := range []string{upperDir, workDir, rootfsPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create '%s': %w", dir, err)
+		}
+	}
+	if overlay.UpperDir, err = filepath.Abs(upperDir); err != nil {
+		return nil, fmt.Errorf("failed to resolve '%s': %w", upperDir, err)
+	}
+	if overlay.WorkDir, err = filepath.Abs(workDir); err != nil {
+		return nil, fmt.Errorf("failed to resolve '%s': %w", workDir, err)
+	}
+
+	if err := overlay.Validate(); err != nil {
+		return nil, err
+	}
+	return overlay, nil
+}
+
 func HandleChildInit(args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("child-init requires container ID argument")
 	}
 	containerID := args[0]
 
+	// The user, capabilities, no_new_privs and seccomp filters are per
+	// thread: set them up on the thread that execs the container process.
+	runtime.LockOSThread()
+
 	fmt.Printf("[Child %d] Initializing container %s...\n", os.Getpid(), containerID)
 
 	containerBasePath := filepath.Join("_containers", containerID)
@@ -208,6 +359,44 @@ func HandleChildInit(args []string) error {
 		}
 	}
 
+	capabilities := runConfig.ProcessConfig.Capabilities
+	if capabilities == nil {
+		capabilities = run.DefaultCapabilities()
+	}
+	user := runConfig.ProcessConfig.User
+	if user.Username != "" {
+		if user, err = run.ResolveUser(user.Username, "/"); err != nil {
+			return fmt.Errorf("[Child] %w", err)
+		}
+	}
+
+	seccomp := runConfig.Seccomp
+	if seccomp == nil {
+		seccomp = run.DefaultSeccompProfile()
+	}
+	// Without no_new_privs installing a filter needs CAP_SYS_ADMIN, so it
+	// goes in before the user is switched and capabilities are dropped; the
+	// profile must then allow the syscalls that do so.
+	if !runConfig.ProcessConfig.NoNewPrivileges {
+		if err := run.ApplySeccomp(seccomp, capabilities); err != nil {
+			return fmt.Errorf("[Child] %w", err)
+		}
+	}
+	if err := run.SetUser(user); err != nil {
+		return fmt.Errorf("[Child] %w", err)
+	}
+	if err := run.ApplyCapabilities(capabilities); err != nil {
+		return fmt.Errorf("[Child] %w", err)
+	}
+	if runConfig.ProcessConfig.NoNewPrivileges {
+		if err := run.SetNoNewPrivileges(); err != nil {
+			return fmt.Errorf("[Child] %w", err)
+		}
+		if err := run.ApplySeccomp(seccomp, capabilities); err != nil {
+			return fmt.Errorf("[Child] %w", err)
+		}
+	}
+
 	finalEnv := append(os.Environ(), runConfig.ProcessConfig.Env...)
 
 	if err := syscall.Exec(executable, containerCmd, finalEnv); err != nil {
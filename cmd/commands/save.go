@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+	"github.com/spf13/cobra"
+)
+
+var (
+	saveOutput   string
+	saveFormat   string
+	savePlatform string
+)
+
+var saveCmd = &cobra.Command{
+	Use:   "save [image...]",
+	Short: "Save images to a docker-archive or OCI-archive tarball",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var refs []utiles.Reference
+		for _, imageName := range args {
+			ref, err := utiles.ParseReference(imageName)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, ref)
+		}
+		platform, err := platformFromFlag(savePlatform)
+		if err != nil {
+			return err
+		}
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+
+		if saveOutput == "" || saveOutput == "-" {
+			if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				return fmt.Errorf("refusing to write an archive to a terminal, use -o or redirect stdout")
+			}
+			return oci.SaveArchive(store, refs, saveFormat, platform, os.Stdout)
+		}
+
+		// Write next to the destination and rename, so a failed save never
+		// leaves a truncated archive behind.
+		tmp, err := os.CreateTemp(filepath.Dir(saveOutput), "."+filepath.Base(saveOutput)+"-")
+		if err != nil {
+			return fmt.Errorf("failed to create archive '%s': %w", saveOutput, err)
+		}
+		defer os.Remove(tmp.Name())
+		if err := saveTo(tmp, store, refs, platform); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), saveOutput); err != nil {
+			return fmt.Errorf("failed to write archive '%s': %w", saveOutput, err)
+		}
+		return nil
+	},
+}
+
+func saveTo(f *os.File, store *oci.Store, refs []utiles.Reference, platform specs.Platform) error {
+	if err := oci.SaveArchive(store, refs, saveFormat, platform, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write archive '%s': %w", saveOutput, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write archive '%s': %w", saveOutput, err)
+	}
+	return nil
+}
+
+func init() {
+	saveCmd.Flags().StringVarP(&saveOutput, "output", "o", "", "Write the archive to this file instead of stdout")
+	saveCmd.Flags().StringVar(&saveFormat, "format", oci.ArchiveFormatDocker, "Archive format: docker-archive or oci-archive")
+	saveCmd.Flags().StringVar(&savePlatform, "platform", "", "Platform to save for docker-archive when an image is multi-platform (os/arch[/variant])")
+}
@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+type securityOptions struct {
+	seccomp         *run.SeccompProfile
+	noNewPrivileges *bool
+}
+
+// parseSecurityOpts reads Docker-style --security-opt values:
+// seccomp=<profile.json>, seccomp=unconfined and no-new-privileges[=bool].
+func parseSecurityOpts(opts []string) (*securityOptions, error) {
+	parsed := &securityOptions{}
+	for _, opt := range opts {
+		name, value, hasValue := strings.Cut(opt, "=")
+		if !hasValue {
+			name, value, hasValue = strings.Cut(opt, ":")
+		}
+		switch name {
+		case "seccomp":
+			if value == "" {
+				return nil, fmt.Errorf("security-opt '%s' needs a profile or 'unconfined'", opt)
+			}
+			if value == "unconfined" {
+				parsed.seccomp = run.UnconfinedSeccompProfile()
+				continue
+			}
+			profile, err := run.ReadSeccompProfile(value)
+			if err != nil {
+				return nil, err
+			}
+			parsed.seccomp = profile
+		case "no-new-privileges":
+			enabled := true
+			if hasValue {
+				var err error
+				if enabled, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("invalid security-opt '%s': %w", opt, err)
+				}
+			}
+			parsed.noNewPrivileges = &enabled
+		default:
+			return nil, fmt.Errorf("unsupported security-opt '%s'", opt)
+		}
+	}
+	return parsed, nil
+}
+
+func (o *securityOptions) apply(config *run.ImageConfig) {
+	if o.seccomp != nil {
+		config.Seccomp = o.seccomp
+	}
+	if o.noNewPrivileges != nil {
+		config.ProcessConfig.NoNewPrivileges = *o.noNewPrivileges
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var startResources resourceFlags
+
 var startCmd = &cobra.Command{
 	Use:   "start [containerID]",
 	Short: "Start (re-run) an existing container",
@@ -35,6 +37,17 @@ var startCmd = &cobra.Command{
 			return fmt.Errorf("failed to parse container config '%s': %w", configFilePath, err)
 		}
 
+		resources, err := startResources.resources(cmd, runConfig.Resources)
+		if err != nil {
+			return err
+		}
+		if resourceFlagsChanged(cmd) {
+			runConfig.Resources = resources
+			if err := writeContainerConfig(containerID, &runConfig); err != nil {
+				return err
+			}
+		}
+
 		fmt.Printf("Starting container %s...\n", containerID)
 
 		childArgs := []string{"child-init", containerID}
@@ -48,19 +61,20 @@ var startCmd = &cobra.Command{
 		hostGID := os.Getgid()
 		run.ApplyNamespaces(childCmd, hostUID, hostGID)
 
-		fmt.Printf("Starting container process (ID: %s)...\n", containerID)
-		if err := childCmd.Start(); err != nil {
-			return fmt.Errorf("failed to start container process: %w", err)
-		}
-
-		err = childCmd.Wait()
-
+		state, err := runContainerProcess(containerID, &runConfig, childCmd)
 		if err != nil {
-			fmt.Printf("Container process exited with error: %v\n", err)
-		} else {
-			fmt.Printf("Container %s finished successfully.\n", containerID)
+			return err
 		}
 
-		return err
+		if state.ExitCode != 0 {
+			fmt.Printf("Container process exited with error: %s\n", state.Describe())
+			return fmt.Errorf("container %s %s", containerID, state.Describe())
+		}
+		fmt.Printf("Container %s finished successfully.\n", containerID)
+		return nil
 	},
 }
+
+func init() {
+	addResourceFlags(startCmd, &startResources)
+}
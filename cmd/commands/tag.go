@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+	"github.com/spf13/cobra"
+)
+
+var tagCmd = &cobra.Command{
+	Use:   "tag [source] [target]",
+	Short: "Add a name to an existing image",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openImageStore()
+		if err != nil {
+			return err
+		}
+		desc, _, err := resolveImageArg(store, args[0])
+		if err != nil {
+			return err
+		}
+		target, err := utiles.ParseReference(args[1])
+		if err != nil {
+			return err
+		}
+		if target.Digest != "" {
+			return fmt.Errorf("cannot tag with a digest reference '%s'", args[1])
+		}
+
+		if err := store.Tag(target, desc); err != nil {
+			return fmt.Errorf("failed to tag image '%s': %w", args[0], err)
+		}
+		fmt.Printf("Tagged %s as %s\n", desc.Digest.Encoded()[:12], target)
+		return nil
+	},
+}
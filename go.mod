@@ -11,8 +11,11 @@ require (
 replace github.com/imdario/mergo => dario.cat/mergo v1.0.1
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.1.0
+	golang.org/x/sys v0.35.0
+	golang.org/x/term v0.34.0
 )
 
 require (
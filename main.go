@@ -6,6 +6,7 @@ import (
 
 	"github.com/souhailBektachi/container_runtime_with_go/cmd"
 	"github.com/souhailBektachi/container_runtime_with_go/cmd/commands"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
 )
 
 func main() {
@@ -18,6 +19,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == run.OverlayProbeArg {
+		if err := run.HandleOverlayProbe(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
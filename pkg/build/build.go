@@ -0,0 +1,653 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/oci"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+)
+
+// Options configures a build. RUN steps are executed as temporary
+// containers in ContainerDir, on an overlay of the image's snapshots when
+// Snapshotter is set and on an unpacked copy of the layers otherwise.
+type Options struct {
+	Store                  *oci.Store
+	Snapshotter            *oci.Snapshotter
+	ContextDir             string
+	ContainerDir           string
+	Platform               specs.Platform
+	IDMaps                 run.IDMappings
+	MaxConcurrentDownloads int
+	// SourceDateEpoch, when set, is used for every timestamp in the image
+	// so that rebuilding the same context yields the same image.
+	SourceDateEpoch *time.Time
+}
+
+type builder struct {
+	opts   Options
+	config oci.OciConfig
+	layers []specs.Descriptor
+	cmdSet bool
+}
+
+// Build executes instructions and stores the resulting image's config and
+// manifest blobs. It returns the manifest descriptor; naming the image is
+// left to the caller.
+func Build(instructions []Instruction, opts Options) (specs.Descriptor, error) {
+	b := &builder{opts: opts}
+	for i, inst := range instructions {
+		fmt.Printf("STEP %d/%d: %s\n", i+1, len(instructions), inst)
+		if err := b.step(inst); err != nil {
+			return specs.Descriptor{}, fmt.Errorf("line %d: %s: %w", inst.Line, inst.Command, err)
+		}
+	}
+	return b.writeImage()
+}
+
+func (b *builder) env() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range b.config.Config.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func (b *builder) setEnv(key, value string) {
+	for i, kv := range b.config.Config.Env {
+		if k, _, _ := strings.Cut(kv, "="); k == key {
+			b.config.Config.Env[i] = key + "=" + value
+			return
+		}
+	}
+	b.config.Config.Env = append(b.config.Config.Env, key+"="+value)
+}
+
+func (b *builder) now() string {
+	if b.opts.SourceDateEpoch != nil {
+		return b.opts.SourceDateEpoch.UTC().Format(time.RFC3339)
+	}
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+func (b *builder) layerOptions() oci.LayerOptions {
+	return oci.LayerOptions{IDMaps: b.opts.IDMaps, SourceDateEpoch: b.opts.SourceDateEpoch}
+}
+
+func (b *builder) addHistory(createdBy string, emptyLayer bool) {
+	created := b.now()
+	b.config.History = append(b.config.History, oci.OciHistory{Created: &created, CreatedBy: createdBy, EmptyLayer: emptyLayer})
+}
+
+func (b *builder) step(inst Instruction) error {
+	switch inst.Command {
+	case "FROM":
+		return b.from(inst.Args)
+	case "RUN":
+		args, ok := execForm(inst.Args)
+		createdBy := inst.String()
+		if !ok {
+			args = []string{"/bin/sh", "-c", inst.Args}
+			createdBy = "RUN /bin/sh -c " + inst.Args
+		}
+		return b.run(args, createdBy)
+	case "COPY", "ADD":
+		words, ok := execForm(inst.Args)
+		if !ok {
+			var err error
+			if words, err = splitWords(inst.Args, b.env()); err != nil {
+				return err
+			}
+		}
+		if len(words) < 2 {
+			return fmt.Errorf("requires at least one source and a destination")
+		}
+		return b.copyFiles(words[:len(words)-1], words[len(words)-1], inst.Command == "ADD", inst.String())
+	}
+
+	words, err := splitWords(inst.Args, b.env())
+	if err != nil {
+		return err
+	}
+	switch inst.Command {
+	case "ENV":
+		if len(words) > 0 && !strings.Contains(words[0], "=") {
+			// Legacy form: ENV KEY value with spaces
+			b.setEnv(words[0], strings.Join(words[1:], " "))
+			break
+		}
+		for _, word := range words {
+			key, value, ok := strings.Cut(word, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("expected KEY=VALUE, got '%s'", word)
+			}
+			b.setEnv(key, value)
+		}
+	case "LABEL":
+		if b.config.Config.Labels == nil {
+			b.config.Config.Labels = make(map[string]string)
+		}
+		for _, word := range words {
+			key, value, ok := strings.Cut(word, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("expected KEY=VALUE, got '%s'", word)
+			}
+			b.config.Config.Labels[key] = value
+		}
+	case "EXPOSE":
+		if b.config.Config.ExposedPorts == nil {
+			b.config.Config.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range words {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			b.config.Config.ExposedPorts[port] = struct{}{}
+		}
+	case "WORKDIR":
+		if len(words) != 1 {
+			return fmt.Errorf("requires exactly one path")
+		}
+		b.config.Config.WorkingDir = b.containerPath(words[0])
+	case "USER":
+		if len(words) != 1 {
+			return fmt.Errorf("requires exactly one user")
+		}
+		b.config.Config.User = words[0]
+	case "ENTRYPOINT", "CMD":
+		args, ok := execForm(inst.Args)
+		if !ok {
+			args = []string{"/bin/sh", "-c", inst.Args}
+		}
+		if inst.Command == "CMD" {
+			b.config.Config.Cmd = args
+			b.cmdSet = true
+		} else {
+			b.config.Config.Entrypoint = args
+			// A new entrypoint makes the base image's CMD meaningless.
+			if !b.cmdSet {
+				b.config.Config.Cmd = nil
+			}
+		}
+	}
+	b.addHistory(inst.String(), true)
+	return nil
+}
+
+// containerPath resolves p against the current WORKDIR.
+func (b *builder) containerPath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	workDir := b.config.Config.WorkingDir
+	if workDir == "" {
+		workDir = "/"
+	}
+	return path.Join(workDir, p)
+}
+
+func (b *builder) from(args string) error {
+	words, err := splitWords(args, nil)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 && !(len(words) == 3 && strings.EqualFold(words[1], "AS")) {
+		return fmt.Errorf("expected 'FROM image [AS name]'")
+	}
+
+	if words[0] == "scratch" {
+		b.config.Architecture = b.opts.Platform.Architecture
+		b.config.OS = b.opts.Platform.OS
+		b.config.Variant = b.opts.Platform.Variant
+		b.config.RootFS.Type = "layers"
+		return nil
+	}
+
+	ref, err := utiles.ParseReference(words[0])
+	if err != nil {
+		return err
+	}
+	store := b.opts.Store
+	manifestDigest, err := store.ResolveManifest(ref, b.opts.Platform)
+	if err != nil {
+		fmt.Printf("Image '%s' not found locally, pulling...\n", ref)
+		pullOpts := oci.PullOptions{
+			Platform:               b.opts.Platform,
+			MaxConcurrentDownloads: b.opts.MaxConcurrentDownloads,
+			Snapshotter:            b.opts.Snapshotter,
+		}
+		if _, err := oci.PullImage(store, ref, pullOpts); err != nil {
+			return fmt.Errorf("failed to pull base image '%s': %w", ref, err)
+		}
+		if manifestDigest, err = store.ResolveManifest(ref, b.opts.Platform); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := oci.ReadManifest(store.Root, manifestDigest.String())
+	if err != nil {
+		return err
+	}
+	config, err := oci.ReadConfig(store.Root, manifest.Config.Digest.String())
+	if err != nil {
+		return err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("base image '%s' config lists %d diff_ids but manifest has %d layers", ref, len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	b.config = *config
+	b.layers = manifest.Layers
+	return nil
+}
+
+func (b *builder) addLayer(desc specs.Descriptor, diffID digest.Digest, createdBy string) {
+	b.layers = append(b.layers, desc)
+	b.config.RootFS.DiffIDs = append(b.config.RootFS.DiffIDs, diffID.String())
+	b.addHistory(createdBy, false)
+}
+
+func (b *builder) imageLayers() []oci.Layer {
+	layers := make([]oci.Layer, len(b.layers))
+	for i, desc := range b.layers {
+		layers[i] = oci.Layer{
+			Path:      b.opts.Store.BlobPath(desc.Digest),
+			MediaType: desc.MediaType,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+			DiffID:    digest.Digest(b.config.RootFS.DiffIDs[i]),
+		}
+	}
+	return layers
+}
+
+func (b *builder) newStepDir() (string, string, error) {
+	id := "build-" + uuid.New().String()[:8]
+	dir := filepath.Join(b.opts.ContainerDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create build container directory '%s': %w", dir, err)
+	}
+	return id, dir, nil
+}
+
+// run executes args in a container on top of the current layers and turns
+// whatever it changed into a new layer.
+func (b *builder) run(args []string, createdBy string) error {
+	containerID, containerDir, err := b.newStepDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(containerDir)
+	rootfsPath := filepath.Join(containerDir, "rootfs")
+
+	stepConfig := b.config
+	stepConfig.Config.Entrypoint = nil
+	stepConfig.Config.Cmd = args
+	runConfig, err := oci.MapOciConfigToRunConfig(&stepConfig, rootfsPath)
+	if err != nil {
+		return err
+	}
+	cwd := runConfig.ProcessConfig.Cwd
+
+	var changesRoot, baseDir string
+	var lowerDirs []string
+	if b.opts.Snapshotter != nil {
+		if lowerDirs, err = b.opts.Snapshotter.Prepare(b.imageLayers()); err != nil {
+			return err
+		}
+		if len(lowerDirs) == 0 {
+			// overlayfs needs at least one lower directory.
+			lowerDirs = []string{filepath.Join(containerDir, "empty")}
+		}
+		overlay := &run.OverlayConfig{UserXattr: b.opts.Snapshotter.UserXattr}
+		for _, dir := range lowerDirs {
+			absDir, err := filepath.Abs(dir)
+			if err != nil {
+				return fmt.Errorf("failed to resolve snapshot path '%s': %w", dir, err)
+			}
+			overlay.LowerDirs = append(overlay.LowerDirs, absDir)
+		}
+		changesRoot = filepath.Join(containerDir, "upper")
+		workDir := filepath.Join(containerDir, "work")
+		for _, dir := range append([]string{changesRoot, workDir, rootfsPath}, overlay.LowerDirs...) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create '%s': %w", dir, err)
+			}
+		}
+		if overlay.UpperDir, err = filepath.Abs(changesRoot); err != nil {
+			return err
+		}
+		if overlay.WorkDir, err = filepath.Abs(workDir); err != nil {
+			return err
+		}
+		if err := overlay.Validate(); err != nil {
+			return err
+		}
+		runConfig.Root.Overlay = overlay
+
+		if !existsInLowers(lowerDirs, cwd) {
+			if err := os.MkdirAll(filepath.Join(changesRoot, cwd), 0755); err != nil {
+				return fmt.Errorf("failed to create working directory '%s': %w", cwd, err)
+			}
+		}
+	} else {
+		changesRoot = rootfsPath
+		baseDir = filepath.Join(containerDir, "base")
+		if err := oci.UnpackImageLayers(b.imageLayers(), rootfsPath, b.opts.IDMaps); err != nil {
+			return fmt.Errorf("failed to unpack layers: %w", err)
+		}
+		if err := oci.UnpackImageLayers(b.imageLayers(), baseDir, b.opts.IDMaps); err != nil {
+			return fmt.Errorf("failed to unpack layers: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Join(rootfsPath, cwd), 0755); err != nil {
+			return fmt.Errorf("failed to create working directory '%s': %w", cwd, err)
+		}
+	}
+
+	configBytes, err := json.MarshalIndent(runConfig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal runtime config: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(containerDir, "config.json"), configBytes, 0644); err != nil {
+		return fmt.Errorf("failed to save runtime config: %w", err)
+	}
+
+	childCmd := exec.Command("/proc/self/exe", "child-init", containerID)
+	childCmd.Stdout = os.Stdout
+	childCmd.Stderr = os.Stderr
+	run.ApplyNamespaces(childCmd, os.Getuid(), os.Getgid())
+	if err := childCmd.Run(); err != nil {
+		return fmt.Errorf("command %q failed: %w", args, err)
+	}
+
+	var changes []oci.Change
+	if b.opts.Snapshotter != nil {
+		changes, err = oci.OverlayChanges(changesRoot, lowerDirs)
+	} else {
+		changes, err = oci.TreeChanges(baseDir, rootfsPath)
+	}
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		b.addHistory(createdBy, true)
+		return nil
+	}
+	desc, diffID, err := oci.CreateLayer(b.opts.Store, changesRoot, changes, b.layerOptions())
+	if err != nil {
+		return err
+	}
+	b.addLayer(desc, diffID, createdBy)
+	return nil
+}
+
+func existsInLowers(lowerDirs []string, p string) bool {
+	for _, dir := range lowerDirs {
+		if _, err := os.Stat(filepath.Join(dir, p)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFiles stages the sources from the build context at dest and turns them
+// into a new layer. ADD additionally unpacks local tar archives.
+func (b *builder) copyFiles(sources []string, rawDest string, isAdd bool, createdBy string) error {
+	matches, err := b.matchSources(sources)
+	if err != nil {
+		return err
+	}
+
+	dest := b.containerPath(rawDest)
+	destIsDir := strings.HasSuffix(rawDest, "/") || len(matches) > 1
+
+	// Copied files belong to root like with Docker; extracted archives keep
+	// the owners recorded in them.
+	layerOpts := b.layerOptions()
+	extracts := false
+	for _, match := range matches {
+		if info, err := os.Lstat(match); err == nil && isAdd && info.Mode().IsRegular() && oci.IsArchive(match) {
+			extracts = true
+		}
+	}
+	if !extracts {
+		root := 0
+		layerOpts.UID, layerOpts.GID = &root, &root
+	}
+
+	// The layer only depends on the sources and where they go, so it is
+	// cached under a hash of exactly that.
+	key, err := b.copyCacheKey(matches, dest, destIsDir, isAdd)
+	if err != nil {
+		return err
+	}
+	if desc, diffID, ok := b.opts.Store.CachedLayer(key); ok {
+		fmt.Println("Using cached layer")
+		b.addLayer(desc, diffID, createdBy)
+		return nil
+	}
+	layerOpts.CacheKey = key
+
+	_, stepDir, err := b.newStepDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stepDir)
+	stage := filepath.Join(stepDir, "stage")
+
+	var changes []oci.Change
+	record := func(p string) {
+		changes = append(changes, oci.Change{Kind: oci.ChangeAdd, Path: p})
+	}
+	for _, match := range matches {
+		info, err := os.Lstat(match)
+		if err != nil {
+			return fmt.Errorf("failed to stat '%s': %w", match, err)
+		}
+		switch {
+		case info.IsDir():
+			if err := copyTree(match, stage, dest, record); err != nil {
+				return err
+			}
+		case isAdd && info.Mode().IsRegular() && oci.IsArchive(match):
+			target := filepath.Join(stage, dest)
+			if err := oci.ExtractArchive(match, target, b.opts.IDMaps); err != nil {
+				return fmt.Errorf("failed to extract '%s': %w", match, err)
+			}
+			if err := filepath.Walk(target, func(p string, _ os.FileInfo, err error) error {
+				if err == nil && p != target {
+					record(strings.TrimPrefix(p, stage))
+				}
+				return err
+			}); err != nil {
+				return fmt.Errorf("failed to list '%s': %w", target, err)
+			}
+		default:
+			target := dest
+			if destIsDir {
+				target = path.Join(dest, filepath.Base(match))
+			}
+			if err := os.MkdirAll(filepath.Join(stage, path.Dir(target)), 0755); err != nil {
+				return fmt.Errorf("failed to create '%s': %w", path.Dir(target), err)
+			}
+			if err := copyEntry(match, info, filepath.Join(stage, target)); err != nil {
+				return err
+			}
+			record(target)
+		}
+	}
+
+	desc, diffID, err := oci.CreateLayer(b.opts.Store, stage, changes, layerOpts)
+	if err != nil {
+		return err
+	}
+	b.addLayer(desc, diffID, createdBy)
+	return nil
+}
+
+// matchSources expands the COPY or ADD sources to the paths they match in the
+// build context. A match is copied as it is, symlink or not, but the
+// directories leading to it must not leave the context through a symlink.
+func (b *builder) matchSources(sources []string) ([]string, error) {
+	contextDir, err := filepath.EvalSymlinks(b.opts.ContextDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve build context '%s': %w", b.opts.ContextDir, err)
+	}
+
+	var matches []string
+	for _, src := range sources {
+		if strings.Contains(src, "://") {
+			return nil, fmt.Errorf("remote sources are not supported: %s", src)
+		}
+		// Sources are always relative to the context, even with "..".
+		pattern := filepath.Join(b.opts.ContextDir, filepath.Clean("/"+src))
+		found, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source pattern '%s': %w", src, err)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("source '%s' not found in build context", src)
+		}
+		for _, match := range found {
+			parent, err := filepath.EvalSymlinks(filepath.Dir(match))
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve source '%s': %w", match, err)
+			}
+			if parent != contextDir && !strings.HasPrefix(parent, contextDir+string(filepath.Separator)) {
+				return nil, fmt.Errorf("source '%s' is outside the build context", src)
+			}
+		}
+		matches = append(matches, found...)
+	}
+	return matches, nil
+}
+
+// copyCacheKey hashes everything a COPY or ADD layer is made of: the
+// destination, and the path, metadata and content of every source entry.
+// Modification times only count when SourceDateEpoch does not replace them.
+func (b *builder) copyCacheKey(matches []string, dest string, destIsDir, isAdd bool) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "copy\x00%s\x00%t\x00%t\x00", dest, destIsDir, isAdd)
+	if b.opts.SourceDateEpoch != nil {
+		fmt.Fprintf(h, "epoch=%d\x00", b.opts.SourceDateEpoch.Unix())
+	}
+	for _, match := range matches {
+		err := filepath.Walk(match, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(b.opts.ContextDir, p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00%o\x00%d\x00", rel, info.Mode(), info.Size())
+			if b.opts.SourceDateEpoch == nil {
+				fmt.Fprintf(h, "%d\x00", info.ModTime().UnixNano())
+			}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "%s\x00", target)
+			case info.Mode().IsRegular():
+				f, err := os.Open(p)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if _, err := io.Copy(h, f); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to hash source '%s': %w", match, err)
+		}
+	}
+	return "copy:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyTree copies the contents of srcDir to dest inside stage, reporting
+// every container path it creates.
+func copyTree(srcDir, stage, dest string, record func(string)) error {
+	return filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, filepath.ToSlash(rel))
+		if rel == "." {
+			return os.MkdirAll(filepath.Join(stage, target), 0755)
+		}
+		if err := copyEntry(p, info, filepath.Join(stage, target)); err != nil {
+			return err
+		}
+		record(target)
+		return nil
+	})
+}
+
+func copyEntry(src string, info os.FileInfo, dst string) error {
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return fmt.Errorf("failed to create '%s': %w", dst, err)
+		}
+		return os.Chmod(dst, info.Mode().Perm())
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink '%s': %w", src, err)
+		}
+		return os.Symlink(target, dst)
+	case info.Mode().IsRegular():
+		in, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("failed to open '%s': %w", src, err)
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("failed to create '%s': %w", dst, err)
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to copy '%s': %w", src, err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("failed to copy '%s': %w", src, err)
+		}
+		if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return fmt.Errorf("unsupported file type for '%s': %s", src, info.Mode().Type())
+}
+
+func (b *builder) writeImage() (specs.Descriptor, error) {
+	created := b.now()
+	b.config.Created = &created
+	return b.opts.Store.WriteImage(&b.config, b.layers)
+}
@@ -0,0 +1,72 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchSources(t *testing.T) {
+	contextDir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(contextDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "sub/f"} {
+		if err := os.WriteFile(filepath.Join(contextDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"inner": "sub", "escape": outside, "up": ".."} {
+		if err := os.Symlink(target, filepath.Join(contextDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    []string
+		wantErr string
+	}{
+		{name: "file", sources: []string{"a.txt"}, want: []string{"a.txt"}},
+		{name: "parent references stay in the context", sources: []string{"../../a.txt"}, want: []string{"a.txt"}},
+		{name: "symlink inside the context", sources: []string{"inner/f"}, want: []string{"inner/f"}},
+		{name: "symlink itself", sources: []string{"escape"}, want: []string{"escape"}},
+		{name: "through a symlink out of the context", sources: []string{"escape/secret"}, wantErr: "outside the build context"},
+		{name: "glob through a symlink out of the context", sources: []string{"escape/*"}, wantErr: "outside the build context"},
+		{name: "through a symlink to the context's parent", sources: []string{"up/*"}, wantErr: "outside the build context"},
+		{name: "missing", sources: []string{"nope"}, wantErr: "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &builder{opts: Options{ContextDir: contextDir}}
+			matches, err := b.matchSources(tt.sources)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("matchSources(%v) error = %v, want one containing %q", tt.sources, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("matchSources(%v): %v", tt.sources, err)
+			}
+			var got []string
+			for _, match := range matches {
+				rel, err := filepath.Rel(contextDir, match)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, rel)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matchSources(%v) = %v, want %v", tt.sources, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction is one Containerfile instruction. Args holds the text after
+// the keyword (continuation lines joined); variables and quotes in it are
+// only processed when the instruction runs, against the ENV in effect then.
+type Instruction struct {
+	Command string
+	Args    string
+	Line    int
+}
+
+var supportedInstructions = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true, "WORKDIR": true,
+	"USER": true, "ENTRYPOINT": true, "CMD": true, "LABEL": true, "EXPOSE": true,
+}
+
+// String renders the instruction the way it is recorded in image history.
+func (i Instruction) String() string {
+	return i.Command + " " + i.Args
+}
+
+// Parse reads a Containerfile. Only a single FROM stage and the instructions
+// in supportedInstructions are understood.
+func Parse(r io.Reader) ([]Instruction, error) {
+	var instructions []Instruction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		start := lineNo
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			lineNo++
+			next := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(next, "#") {
+				next = ""
+			}
+			line = strings.TrimSuffix(line, "\\") + " " + next
+		}
+		line = strings.TrimSuffix(line, "\\")
+
+		keyword, args := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			keyword, args = line[:i], line[i+1:]
+		}
+		keyword = strings.ToUpper(keyword)
+		if !supportedInstructions[keyword] {
+			return nil, fmt.Errorf("line %d: unsupported instruction '%s'", start, keyword)
+		}
+		inst := Instruction{Command: keyword, Args: strings.TrimSpace(args), Line: start}
+
+		if (keyword == "COPY" || keyword == "ADD" || keyword == "RUN") && strings.HasPrefix(inst.Args, "--") {
+			flag, _, _ := strings.Cut(inst.Args, " ")
+			return nil, fmt.Errorf("line %d: %s flag '%s' is not supported", start, keyword, flag)
+		}
+		if inst.Args == "" {
+			return nil, fmt.Errorf("line %d: %s requires arguments", start, keyword)
+		}
+
+		if keyword == "FROM" && len(instructions) > 0 {
+			return nil, fmt.Errorf("line %d: multi-stage builds are not supported", start)
+		}
+		if keyword != "FROM" && len(instructions) == 0 {
+			return nil, fmt.Errorf("line %d: the first instruction must be FROM", start)
+		}
+		instructions = append(instructions, inst)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Containerfile: %w", err)
+	}
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("Containerfile has no instructions")
+	}
+	return instructions, nil
+}
+
+// execForm returns the arguments of a JSON array instruction (RUN, CMD,
+// ENTRYPOINT, COPY, ADD), or ok=false for the shell form.
+func execForm(args string) ([]string, bool) {
+	if !strings.HasPrefix(args, "[") {
+		return nil, false
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(args), &list); err != nil {
+		return nil, false
+	}
+	return list, true
+}
+
+// splitWords splits s into words like a POSIX shell would, without running
+// anything: quotes group words, backslashes escape, and $VAR / ${VAR} are
+// replaced from env except inside single quotes.
+func splitWords(s string, env map[string]string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in '%s'", s)
+			}
+			word.WriteString(string(runes[i+1 : end]))
+			i = end
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				switch {
+				case runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$", runes[i+1]):
+					i++
+					word.WriteRune(runes[i])
+				case runes[i] == '$':
+					value, n := expandVariable(runes[i:], env)
+					word.WriteString(value)
+					i += n - 1
+				default:
+					word.WriteRune(runes[i])
+				}
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated double quote in '%s'", s)
+			}
+		case c == '$':
+			inWord = true
+			value, n := expandVariable(runes[i:], env)
+			word.WriteString(value)
+			i += n - 1
+		default:
+			inWord = true
+			word.WriteRune(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// expandVariable expands the $NAME or ${NAME} at the start of runes and
+// returns the value and the number of runes consumed. ${NAME:-default} and
+// ${NAME:+alternative} are supported as in Dockerfiles.
+func expandVariable(runes []rune, env map[string]string) (string, int) {
+	if len(runes) < 2 {
+		return "$", 1
+	}
+	if runes[1] == '{' {
+		end := indexRune(runes, 2, '}')
+		if end < 0 {
+			return string(runes), len(runes)
+		}
+		expr := string(runes[2:end])
+		if name, def, ok := strings.Cut(expr, ":-"); ok {
+			if value := env[name]; value != "" {
+				return value, end + 1
+			}
+			return def, end + 1
+		}
+		if name, alt, ok := strings.Cut(expr, ":+"); ok {
+			if env[name] != "" {
+				return alt, end + 1
+			}
+			return "", end + 1
+		}
+		return env[expr], end + 1
+	}
+
+	n := 1
+	for n < len(runes) && (runes[n] == '_' || runes[n] >= 'a' && runes[n] <= 'z' || runes[n] >= 'A' && runes[n] <= 'Z' || n > 1 && runes[n] >= '0' && runes[n] <= '9') {
+		n++
+	}
+	if n == 1 {
+		return "$", 1
+	}
+	return env[string(runes[1:n])], n
+}
@@ -0,0 +1,514 @@
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+)
+
+const (
+	ArchiveFormatDocker = "docker-archive"
+	ArchiveFormatOCI    = "oci-archive"
+
+	dockerManifestFile       = "manifest.json"
+	annotationContainerdName = "io.containerd.image.name"
+)
+
+// LoadArchive imports every named image from a `docker save` archive or an
+// OCI image layout tarball (optionally gzip or zstd compressed) into the
+// store and returns the references it tagged. All blobs are verified against
+// their digests on the way in.
+func LoadArchive(store *Store, r io.Reader) ([]utiles.Reference, error) {
+	stream, err := decompressLayer(r, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer stream.Close()
+
+	if err := os.MkdirAll(filepath.Join(store.Root, ingestDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create ingest directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(filepath.Join(store.Root, ingestDir), "load-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := unpackArchive(stream, dir); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, dockerManifestFile)); err == nil {
+		return loadDockerArchive(store, dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, specs.ImageIndexFile)); err == nil {
+		return loadOCIArchive(store, dir)
+	}
+	return nil, fmt.Errorf("archive contains neither %s nor %s", dockerManifestFile, specs.ImageIndexFile)
+}
+
+// unpackArchive stages the archive's files in dir. Only directories, regular
+// files and symlinks (older `docker save` links duplicate layers) are kept.
+// Every path is resolved with resolveInRoot, so neither entry names nor
+// symlinks can reach outside dir.
+func unpackArchive(r io.Reader, dir string) error {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name := filepath.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		parent, err := resolveInRoot(dir, filepath.Dir(name))
+		if err != nil {
+			return fmt.Errorf("failed to resolve '%s': %w", header.Name, err)
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for '%s': %w", header.Name, err)
+		}
+		target := filepath.Join(parent, filepath.Base(name))
+		if header.Typeflag != tar.TypeDir {
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to replace '%s': %w", header.Name, err)
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to create directory '%s': %w", header.Name, err)
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to create '%s': %w", header.Name, err)
+			}
+			if _, err := io.Copy(f, tarReader); err != nil {
+				f.Close()
+				return fmt.Errorf("failed to write '%s': %w", header.Name, err)
+			}
+			if err := f.Close(); err != nil {
+				return fmt.Errorf("failed to write '%s': %w", header.Name, err)
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink '%s': %w", header.Name, err)
+			}
+		}
+	}
+}
+
+func openArchiveFile(dir, name string) (*os.File, error) {
+	p, err := resolveInRoot(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("archive file '%s' is missing: %w", name, err)
+	}
+	return f, nil
+}
+
+func readArchiveFile(dir, name string) ([]byte, error) {
+	f, err := openArchiveFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func loadDockerArchive(store *Store, dir string) ([]utiles.Reference, error) {
+	manifestBytes, err := readArchiveFile(dir, dockerManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var dockerManifests []DockerManifest
+	if err := json.Unmarshal(manifestBytes, &dockerManifests); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", dockerManifestFile, err)
+	}
+
+	var loaded []utiles.Reference
+	for _, dm := range dockerManifests {
+		configBytes, err := readArchiveFile(dir, dm.Config)
+		if err != nil {
+			return nil, err
+		}
+		var config OciConfig
+		if err := json.Unmarshal(configBytes, &config); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal config '%s': %w", dm.Config, err)
+		}
+		if len(config.RootFS.DiffIDs) != len(dm.Layers) {
+			return nil, fmt.Errorf("config '%s' lists %d diff_ids but the archive has %d layers", dm.Config, len(config.RootFS.DiffIDs), len(dm.Layers))
+		}
+
+		manifest := OciManifest{
+			SchemaVersion: 2,
+			MediaType:     specs.MediaTypeImageManifest,
+			Config: specs.Descriptor{
+				MediaType: specs.MediaTypeImageConfig,
+				Digest:    digest.FromBytes(configBytes),
+				Size:      int64(len(configBytes)),
+			},
+		}
+		if err := store.WriteBlob(manifest.Config.Digest, configBytes); err != nil {
+			return nil, err
+		}
+
+		for i, layerPath := range dm.Layers {
+			desc, err := importDockerLayer(store, dir, layerPath, digest.Digest(config.RootFS.DiffIDs[i]))
+			if err != nil {
+				return nil, err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+
+		imageBytes, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+		}
+		desc := specs.Descriptor{
+			MediaType: specs.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(imageBytes),
+			Size:      int64(len(imageBytes)),
+		}
+		if err := store.WriteBlob(desc.Digest, imageBytes); err != nil {
+			return nil, err
+		}
+
+		if len(dm.RepoTags) == 0 {
+			fmt.Fprintf(os.Stderr, "warning: skipping untagged image with config %s\n", manifest.Config.Digest)
+			continue
+		}
+		for _, name := range dm.RepoTags {
+			ref, err := utiles.ParseReference(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag '%s' in %s: %w", name, dockerManifestFile, err)
+			}
+			if err := store.Tag(ref, desc); err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, ref)
+		}
+	}
+	return loaded, nil
+}
+
+// importDockerLayer stores a layer file from a docker archive. Layers are
+// kept in whatever compression the archive used; the blob digest is computed
+// from the file and the uncompressed content is checked against the diff_id.
+func importDockerLayer(store *Store, dir, layerPath string, diffID digest.Digest) (specs.Descriptor, error) {
+	f, err := openArchiveFile(dir, layerPath)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer f.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(digester.Hash(), f)
+	if err != nil {
+		return specs.Descriptor{}, fmt.Errorf("failed to read layer '%s': %w", layerPath, err)
+	}
+	magic := make([]byte, 4)
+	n, _ := f.ReadAt(magic, 0)
+
+	desc := specs.Descriptor{Digest: digester.Digest(), Size: size}
+	switch detectCompression(magic[:n]) {
+	case compressionGzip:
+		desc.MediaType = specs.MediaTypeImageLayerGzip
+	case compressionZstd:
+		desc.MediaType = specs.MediaTypeImageLayerZstd
+	default:
+		desc.MediaType = specs.MediaTypeImageLayer
+	}
+
+	if err := verifyLayerDiffID(f.Name(), desc, diffID); err != nil {
+		return specs.Descriptor{}, fmt.Errorf("layer '%s': %w", layerPath, err)
+	}
+	if store.reuseBlob(desc.Digest) {
+		return desc, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return specs.Descriptor{}, fmt.Errorf("failed to rewind layer '%s': %w", layerPath, err)
+	}
+	if err := store.IngestBlob(desc.Digest, desc.Size, f); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func loadOCIArchive(store *Store, dir string) ([]utiles.Reference, error) {
+	indexBytes, err := readArchiveFile(dir, specs.ImageIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	var index OciIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", specs.ImageIndexFile, err)
+	}
+
+	var loaded []utiles.Reference
+	for _, desc := range index.Manifests {
+		if err := importLayoutBlobs(store, dir, desc); err != nil {
+			return nil, err
+		}
+
+		name := archiveImageName(desc)
+		if name == "" {
+			fmt.Fprintf(os.Stderr, "warning: skipping image %s without a full reference name\n", desc.Digest)
+			continue
+		}
+		ref, err := utiles.ParseReference(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image name '%s' in %s: %w", name, specs.ImageIndexFile, err)
+		}
+		if err := store.Tag(ref, specs.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}); err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, ref)
+	}
+	return loaded, nil
+}
+
+// archiveImageName picks the image name from an OCI layout index entry.
+// org.opencontainers.image.ref.name is often just a tag, which is not enough
+// to name an image in the store.
+func archiveImageName(desc specs.Descriptor) string {
+	if name := desc.Annotations[annotationContainerdName]; name != "" {
+		return name
+	}
+	name := desc.Annotations[specs.AnnotationRefName]
+	if strings.ContainsAny(name, "/:@") {
+		return name
+	}
+	return ""
+}
+
+// importLayoutBlobs copies desc and every blob it references from an image
+// layout into the store. Platforms whose manifests the layout does not
+// contain are skipped, as `docker save --platform` leaves them out.
+func importLayoutBlobs(store *Store, dir string, desc specs.Descriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid digest '%s' in archive: %w", desc.Digest, err)
+	}
+	blobName := archiveBlobName(desc.Digest)
+
+	var content []byte
+	if IsIndexMediaType(desc.MediaType) || desc.MediaType == specs.MediaTypeImageManifest || desc.MediaType == MediaTypeDockerManifest {
+		var err error
+		if content, err = readArchiveFile(dir, blobName); err != nil {
+			return err
+		}
+		if err := store.WriteBlob(desc.Digest, content); err != nil {
+			return err
+		}
+	} else if !store.reuseBlob(desc.Digest) {
+		f, err := openArchiveFile(dir, blobName)
+		if err != nil {
+			return err
+		}
+		err = store.IngestBlob(desc.Digest, desc.Size, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	switch {
+	case IsIndexMediaType(desc.MediaType):
+		var index OciIndex
+		if err := json.Unmarshal(content, &index); err != nil {
+			return fmt.Errorf("failed to unmarshal index %s: %w", desc.Digest, err)
+		}
+		for _, m := range index.Manifests {
+			if err := m.Digest.Validate(); err != nil {
+				return fmt.Errorf("invalid digest '%s' in archive: %w", m.Digest, err)
+			}
+			p, err := resolveInRoot(dir, archiveBlobName(m.Digest))
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				continue
+			}
+			if err := importLayoutBlobs(store, dir, m); err != nil {
+				return err
+			}
+		}
+	case desc.MediaType == specs.MediaTypeImageManifest || desc.MediaType == MediaTypeDockerManifest:
+		var manifest OciManifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return fmt.Errorf("failed to unmarshal manifest %s: %w", desc.Digest, err)
+		}
+		for _, blob := range append([]specs.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := importLayoutBlobs(store, dir, blob); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SaveArchive writes the given images to w as a tarball in format.
+// docker-archive needs a single manifest per image, so multi-platform images
+// are narrowed down to platform; oci-archive keeps them as they are stored.
+func SaveArchive(store *Store, refs []utiles.Reference, format string, platform specs.Platform, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	written := make(map[digest.Digest]bool)
+	writeBlob := func(dgst digest.Digest) error {
+		if written[dgst] {
+			return nil
+		}
+		written[dgst] = true
+		return addBlobToArchive(tw, store, dgst)
+	}
+
+	switch format {
+	case ArchiveFormatOCI:
+		index := OciIndex{SchemaVersion: 2, MediaType: specs.MediaTypeImageIndex}
+		for _, ref := range refs {
+			desc, err := store.Resolve(ref)
+			if err != nil {
+				return err
+			}
+			blobs := store.reachableBlobs(desc)
+			sort.Slice(blobs, func(i, j int) bool { return blobs[i] < blobs[j] })
+			for _, dgst := range blobs {
+				if err := writeBlob(dgst); err != nil {
+					return err
+				}
+			}
+			desc.Annotations = map[string]string{
+				specs.AnnotationRefName:  ref.String(),
+				annotationContainerdName: ref.String(),
+			}
+			index.Manifests = append(index.Manifests, desc)
+		}
+		layoutBytes, err := json.Marshal(specs.ImageLayout{Version: specs.ImageLayoutVersion})
+		if err != nil {
+			return fmt.Errorf("failed to marshal oci-layout: %w", err)
+		}
+		if err := addFileToArchive(tw, specs.ImageLayoutFile, layoutBytes); err != nil {
+			return err
+		}
+		indexBytes, err := json.Marshal(index)
+		if err != nil {
+			return fmt.Errorf("failed to marshal index: %w", err)
+		}
+		if err := addFileToArchive(tw, specs.ImageIndexFile, indexBytes); err != nil {
+			return err
+		}
+
+	case ArchiveFormatDocker:
+		var dockerManifests []DockerManifest
+		byManifest := make(map[digest.Digest]int)
+		for _, ref := range refs {
+			manifestDigest, err := store.ResolveManifest(ref, platform)
+			if err != nil {
+				return err
+			}
+			if i, ok := byManifest[manifestDigest]; ok {
+				if ref.Tag != "" {
+					dockerManifests[i].RepoTags = append(dockerManifests[i].RepoTags, ref.Name()+":"+ref.Tag)
+				}
+				continue
+			}
+			manifest, err := ReadManifest(store.Root, manifestDigest.String())
+			if err != nil {
+				return err
+			}
+
+			dm := DockerManifest{Config: archiveBlobName(manifest.Config.Digest)}
+			if ref.Tag != "" {
+				dm.RepoTags = append(dm.RepoTags, ref.Name()+":"+ref.Tag)
+			} else {
+				fmt.Fprintf(os.Stderr, "warning: '%s' has no tag, it will be saved untagged\n", ref)
+			}
+			if err := writeBlob(manifest.Config.Digest); err != nil {
+				return err
+			}
+			for _, layer := range manifest.Layers {
+				if err := writeBlob(layer.Digest); err != nil {
+					return err
+				}
+				dm.Layers = append(dm.Layers, archiveBlobName(layer.Digest))
+			}
+			byManifest[manifestDigest] = len(dockerManifests)
+			dockerManifests = append(dockerManifests, dm)
+		}
+		manifestBytes, err := json.Marshal(dockerManifests)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", dockerManifestFile, err)
+		}
+		if err := addFileToArchive(tw, dockerManifestFile, manifestBytes); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown archive format '%s' (expected %s or %s)", format, ArchiveFormatDocker, ArchiveFormatOCI)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return nil
+}
+
+func archiveBlobName(dgst digest.Digest) string {
+	return path.Join(specs.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func addFileToArchive(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+		return fmt.Errorf("failed to write archive entry '%s': %w", name, err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		return fmt.Errorf("failed to write archive entry '%s': %w", name, err)
+	}
+	return nil
+}
+
+func addBlobToArchive(tw *tar.Writer, store *Store, dgst digest.Digest) error {
+	f, err := os.Open(store.BlobPath(dgst))
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %w", dgst, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat blob %s: %w", dgst, err)
+	}
+
+	name := archiveBlobName(dgst)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: info.Size()}); err != nil {
+		return fmt.Errorf("failed to write archive entry '%s': %w", name, err)
+	}
+	verifier, err := newVerifyingReader(f, "blob", dgst, info.Size())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, verifier); err != nil {
+		return fmt.Errorf("failed to write archive entry '%s': %w", name, err)
+	}
+	return verifier.check()
+}
@@ -0,0 +1,213 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Credentials struct {
+	Username string
+	Password string
+}
+
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+type bearerToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]bearerToken
+}
+
+func (c *tokenCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tok, ok := c.tokens[key]
+	if !ok || (!tok.ExpiresAt.IsZero() && time.Now().After(tok.ExpiresAt)) {
+		return "", false
+	}
+	return tok.Token, true
+}
+
+func (c *tokenCache) set(key string, tok bearerToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]bearerToken)
+	}
+	c.tokens[key] = tok
+}
+
+func (c *tokenCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, key)
+}
+
+func parseAuthChallenge(header string) (authChallenge, error) {
+	header = strings.TrimSpace(header)
+	scheme, rest, _ := strings.Cut(header, " ")
+	if scheme == "" {
+		return authChallenge{}, fmt.Errorf("empty WWW-Authenticate header")
+	}
+	challenge := authChallenge{Scheme: strings.ToLower(scheme), Params: make(map[string]string)}
+
+	rest = strings.TrimSpace(rest)
+	for rest != "" {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return authChallenge{}, fmt.Errorf("unterminated quoted value in WWW-Authenticate header %q", header)
+			}
+			challenge.Params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, remainder, _ := strings.Cut(value, ",")
+			challenge.Params[key] = strings.TrimSpace(v)
+			rest = remainder
+		}
+		rest = strings.TrimLeft(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return challenge, nil
+}
+
+func (c *RegistryClient) fetchToken(challenge authChallenge, scope string) (bearerToken, error) {
+	realm := challenge.Params["realm"]
+	if realm == "" {
+		return bearerToken{}, fmt.Errorf("bearer challenge from '%s' has no realm", c.Host)
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return bearerToken{}, fmt.Errorf("invalid token realm '%s': %w", realm, err)
+	}
+	query := tokenURL.Query()
+	if service := challenge.Params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return bearerToken{}, fmt.Errorf("failed to create token request for '%s': %w", tokenURL, err)
+	}
+	if c.Credentials != nil {
+		req.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return bearerToken{}, fmt.Errorf("token request to '%s' failed: %w", tokenURL.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return bearerToken{}, fmt.Errorf("token request to '%s' returned %s: %s", tokenURL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		IssuedAt    string `json:"issued_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return bearerToken{}, fmt.Errorf("failed to decode token response from '%s': %w", tokenURL.Host, err)
+	}
+
+	tok := bearerToken{Token: tokenResp.Token}
+	if tok.Token == "" {
+		tok.Token = tokenResp.AccessToken
+	}
+	if tok.Token == "" {
+		return bearerToken{}, fmt.Errorf("token response from '%s' contained no token", tokenURL.Host)
+	}
+
+	expiresIn := tokenResp.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = 60
+	}
+	issuedAt := time.Now()
+	if t, err := time.Parse(time.RFC3339, tokenResp.IssuedAt); err == nil && t.Before(issuedAt) {
+		issuedAt = t
+	}
+	// Refresh a little early so long pulls don't race the expiry.
+	tok.ExpiresAt = issuedAt.Add(time.Duration(expiresIn)*time.Second - 10*time.Second)
+	return tok, nil
+}
+
+func (c *RegistryClient) authorize(req *http.Request, scope string) {
+	if tok, ok := c.tokens.get(scope); ok {
+		req.Header.Set("Authorization", "Bearer "+tok)
+		return
+	}
+	if c.basicAuth.Load() && c.Credentials != nil {
+		req.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+	}
+}
+
+func (c *RegistryClient) handleChallenge(resp *http.Response, scope string) error {
+	header := resp.Header.Get("WWW-Authenticate")
+	if header == "" {
+		return fmt.Errorf("registry '%s' returned %s without an authentication challenge", c.Host, resp.Status)
+	}
+	challenge, err := parseAuthChallenge(header)
+	if err != nil {
+		return err
+	}
+
+	switch challenge.Scheme {
+	case "basic":
+		if c.Credentials == nil {
+			return fmt.Errorf("registry '%s' requires basic authentication; run 'login %s' first", c.Host, c.Host)
+		}
+		if c.basicAuth.Load() {
+			return fmt.Errorf("registry '%s' rejected the stored credentials for user '%s'", c.Host, c.Credentials.Username)
+		}
+		c.basicAuth.Store(true)
+		return nil
+	case "bearer":
+		requestScope := scope
+		if requestScope == "" {
+			requestScope = challenge.Params["scope"]
+		}
+		c.tokens.invalidate(scope)
+		tok, err := c.fetchToken(challenge, requestScope)
+		if err != nil {
+			return err
+		}
+		c.tokens.set(scope, tok)
+		return nil
+	default:
+		return fmt.Errorf("unsupported authentication scheme '%s' from registry '%s'", challenge.Scheme, c.Host)
+	}
+}
+
+func repositoryScope(repository string) string {
+	if repository == "" {
+		return ""
+	}
+	return fmt.Sprintf("repository:%s:pull", repository)
+}
@@ -0,0 +1,312 @@
+package oci
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+type ChangeKind int
+
+const (
+	ChangeAdd ChangeKind = iota
+	ChangeModify
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeModify:
+		return "C"
+	case ChangeDelete:
+		return "D"
+	}
+	return "?"
+}
+
+// Change is one path that differs between a container's rootfs and the image
+// it was created from. Path is absolute inside the container.
+type Change struct {
+	Kind ChangeKind
+	Path string
+}
+
+// Paths the runtime mounts over or creates while setting up a container;
+// whatever appears there is never part of the container's own changes.
+var runtimeOnlyPaths = []string{"/proc", "/sys", "/dev", "/.pivot_root"}
+
+func isRuntimeOnlyPath(p string) bool {
+	for _, prefix := range runtimeOnlyPaths {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func isOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+func isOpaqueDir(path string) bool {
+	for _, name := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		value := make([]byte, 1)
+		if n, err := unix.Lgetxattr(path, name, value); err == nil && n == 1 && value[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// OverlayChanges lists the changes recorded in an overlay upper directory on
+// top of lowerDirs (base layer first). Whiteout devices become deletions;
+// an opaque directory deletes every lower entry it no longer contains.
+func OverlayChanges(upperDir string, lowerDirs []string) ([]Change, error) {
+	inLower := func(rel string) bool {
+		for i := len(lowerDirs) - 1; i >= 0; i-- {
+			info, err := os.Lstat(filepath.Join(lowerDirs[i], rel))
+			if err != nil {
+				continue
+			}
+			return !isOverlayWhiteout(info)
+		}
+		return false
+	}
+
+	var changes []Change
+	err := filepath.Walk(upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(path, upperDir), "/")
+		if rel == "/" {
+			return nil
+		}
+		if isRuntimeOnlyPath(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if isOverlayWhiteout(info) {
+			if inLower(rel) {
+				changes = append(changes, Change{Kind: ChangeDelete, Path: rel})
+			}
+			return nil
+		}
+		kind := ChangeAdd
+		if inLower(rel) {
+			kind = ChangeModify
+		}
+		changes = append(changes, Change{Kind: kind, Path: rel})
+
+		if info.IsDir() && kind == ChangeModify && isOpaqueDir(path) {
+			hidden := make(map[string]bool)
+			for _, lower := range lowerDirs {
+				entries, err := os.ReadDir(filepath.Join(lower, rel))
+				if err != nil {
+					continue
+				}
+				for _, entry := range entries {
+					hidden[entry.Name()] = true
+				}
+			}
+			for name := range hidden {
+				if _, err := os.Lstat(filepath.Join(path, name)); os.IsNotExist(err) {
+					changes = append(changes, Change{Kind: ChangeDelete, Path: filepath.Join(rel, name)})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk overlay upper directory '%s': %w", upperDir, err)
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+// TreeChanges compares dir against baseDir, a copy of the same tree before
+// it was modified. Entries differ when their type, permissions, owner or
+// xattrs do, and files when their size or content does; the content is only
+// hashed when the modification time changed. Directories only count as
+// changed by metadata: their timestamps change whenever an entry is created
+// in them, including while the base is unpacked.
+func TreeChanges(baseDir, dir string) ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(path, dir), "/")
+		if rel == "/" {
+			return nil
+		}
+		if isRuntimeOnlyPath(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		baseInfo, err := os.Lstat(filepath.Join(baseDir, rel))
+		if err != nil {
+			changes = append(changes, Change{Kind: ChangeAdd, Path: rel})
+			return nil
+		}
+		changed, err := entryChanged(filepath.Join(baseDir, rel), baseInfo, path, info)
+		if err != nil {
+			return err
+		}
+		if changed {
+			changes = append(changes, Change{Kind: ChangeModify, Path: rel})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk '%s': %w", dir, err)
+	}
+
+	err = filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(path, baseDir), "/")
+		if rel == "/" || isRuntimeOnlyPath(rel) {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(dir, rel)); err != nil {
+			changes = append(changes, Change{Kind: ChangeDelete, Path: rel})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk '%s': %w", baseDir, err)
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+func entryChanged(basePath string, base os.FileInfo, path string, info os.FileInfo) (bool, error) {
+	if base.Mode() != info.Mode() {
+		return true, nil
+	}
+	baseStat, ok1 := base.Sys().(*syscall.Stat_t)
+	stat, ok2 := info.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 && (baseStat.Uid != stat.Uid || baseStat.Gid != stat.Gid || baseStat.Rdev != stat.Rdev) {
+		return true, nil
+	}
+	if !xattrsEqual(basePath, path) {
+		return true, nil
+	}
+
+	switch {
+	case info.IsDir():
+		return false, nil
+	case info.Mode()&fs.ModeSymlink != 0:
+		baseTarget, err := os.Readlink(basePath)
+		if err != nil {
+			return false, fmt.Errorf("failed to read symlink '%s': %w", basePath, err)
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to read symlink '%s': %w", path, err)
+		}
+		return baseTarget != target, nil
+	}
+	if base.Size() != info.Size() {
+		return true, nil
+	}
+	if base.ModTime().Equal(info.ModTime()) {
+		return false, nil
+	}
+	// Same size but touched since: only a different content counts.
+	baseDigest, err := fileDigest(basePath)
+	if err != nil {
+		return false, err
+	}
+	fileDgst, err := fileDigest(path)
+	if err != nil {
+		return false, err
+	}
+	return baseDigest != fileDgst, nil
+}
+
+func fileDigest(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s': %w", path, err)
+	}
+	defer f.Close()
+	dgst, err := digest.Canonical.FromReader(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash '%s': %w", path, err)
+	}
+	return dgst, nil
+}
+
+// listXattrs returns the extended attributes of path that belong in an image
+// layer. overlayfs bookkeeping attributes are left out.
+func listXattrs(path string) map[string][]byte {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, name, value); err != nil {
+			continue
+		}
+		xattrs[name] = value[:vsize]
+	}
+	return xattrs
+}
+
+func xattrsEqual(a, b string) bool {
+	xa, xb := listXattrs(a), listXattrs(b)
+	if len(xa) != len(xb) {
+		return false
+	}
+	for name, value := range xa {
+		if other, ok := xb[name]; !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+}
@@ -0,0 +1,154 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImageLayers returns the layers of manifest, paired with the diff_ids from
+// config, as stored in the store.
+func (s *Store) ImageLayers(manifest *OciManifest, config *OciConfig) ([]Layer, error) {
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config lists %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	layers := make([]Layer, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		if !s.HasBlob(desc.Digest) {
+			return nil, fmt.Errorf("layer blob %s not found in image store", desc.Digest)
+		}
+		layers[i] = Layer{
+			Path:      s.BlobPath(desc.Digest),
+			MediaType: desc.MediaType,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+			DiffID:    digest.Digest(config.RootFS.DiffIDs[i]),
+		}
+	}
+	return layers, nil
+}
+
+// WriteImage stores config and a manifest listing layers, and returns the
+// manifest's descriptor. The image is not added to the index.
+func (s *Store) WriteImage(config *OciConfig, layers []specs.Descriptor) (specs.Descriptor, error) {
+	if config.RootFS.DiffIDs == nil {
+		config.RootFS.DiffIDs = []string{}
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return specs.Descriptor{}, fmt.Errorf("failed to marshal image config: %w", err)
+	}
+	manifest := OciManifest{
+		SchemaVersion: 2,
+		MediaType:     specs.MediaTypeImageManifest,
+		Config: specs.Descriptor{
+			MediaType: specs.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(configBytes),
+			Size:      int64(len(configBytes)),
+		},
+		Layers: layers,
+	}
+	if manifest.Layers == nil {
+		manifest.Layers = []specs.Descriptor{}
+	}
+	if err := s.WriteBlob(manifest.Config.Digest, configBytes); err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return specs.Descriptor{}, fmt.Errorf("failed to marshal image manifest: %w", err)
+	}
+	desc := specs.Descriptor{
+		MediaType: specs.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifestBytes),
+		Size:      int64(len(manifestBytes)),
+	}
+	if err := s.WriteBlob(desc.Digest, manifestBytes); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+type CommitOptions struct {
+	Author  string
+	Comment string
+	// CreatedBy is recorded in the new history entry, usually the command
+	// the container ran.
+	CreatedBy string
+	// Cmd replaces the image's CMD when set.
+	Cmd []string
+	// Env holds KEY=VALUE pairs set on top of the image's environment.
+	Env   []string
+	Layer LayerOptions
+}
+
+// Commit creates an image from the image whose platform manifest is
+// manifestDigest plus one layer holding changes, read from root (a
+// container's overlay upper directory or rootfs). Without changes only the
+// config is updated. It returns the new manifest's descriptor.
+func Commit(store *Store, manifestDigest digest.Digest, root string, changes []Change, opts CommitOptions) (specs.Descriptor, error) {
+	manifest, err := ReadManifest(store.Root, manifestDigest.String())
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	config, err := ReadConfig(store.Root, manifest.Config.Digest.String())
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return specs.Descriptor{}, fmt.Errorf("image config lists %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	layers := manifest.Layers
+	if len(changes) > 0 {
+		desc, diffID, err := CreateLayer(store, root, changes, opts.Layer)
+		if err != nil {
+			return specs.Descriptor{}, err
+		}
+		layers = append(layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID.String())
+	}
+
+	if opts.Cmd != nil {
+		config.Config.Cmd = opts.Cmd
+	}
+	for _, kv := range opts.Env {
+		key, _, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return specs.Descriptor{}, fmt.Errorf("invalid environment variable '%s' (expected KEY=VALUE)", kv)
+		}
+		replaced := false
+		for i, existing := range config.Config.Env {
+			if k, _, _ := strings.Cut(existing, "="); k == key {
+				config.Config.Env[i] = kv
+				replaced = true
+			}
+		}
+		if !replaced {
+			config.Config.Env = append(config.Config.Env, kv)
+		}
+	}
+
+	now := time.Now().UTC()
+	if opts.Layer.SourceDateEpoch != nil {
+		now = *opts.Layer.SourceDateEpoch
+	}
+	created := now.Format(time.RFC3339Nano)
+	config.Created = &created
+	if opts.Author != "" {
+		config.Author = opts.Author
+	}
+	config.History = append(config.History, OciHistory{
+		Created:    &created,
+		CreatedBy:  opts.CreatedBy,
+		Author:     opts.Author,
+		Comment:    opts.Comment,
+		EmptyLayer: len(changes) == 0,
+	})
+	return store.WriteImage(config, layers)
+}
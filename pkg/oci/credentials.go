@@ -0,0 +1,168 @@
+package oci
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+type AuthEntry struct {
+	Auth string `json:"auth,omitempty"`
+}
+
+// CredentialStore reads and writes the "auths" section of a docker-style
+// config.json. Unknown top-level keys are preserved on save so the store can
+// safely point at an existing ~/.docker/config.json.
+type CredentialStore struct {
+	Path  string
+	Auths map[string]AuthEntry
+
+	extra map[string]json.RawMessage
+}
+
+func DefaultCredentialsPath() (string, error) {
+	if path := os.Getenv("CONTAINER_AUTH_FILE"); path != "" {
+		return path, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine user config directory: %w", err)
+	}
+	return filepath.Join(configDir, "container", "config.json"), nil
+}
+
+func LoadCredentialStore(path string) (*CredentialStore, error) {
+	store := &CredentialStore{
+		Path:  path,
+		Auths: make(map[string]AuthEntry),
+		extra: make(map[string]json.RawMessage),
+	}
+
+	configBytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file '%s': %w", path, err)
+	}
+
+	if err := json.Unmarshal(configBytes, &store.extra); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal credentials file '%s': %w", path, err)
+	}
+	if raw, ok := store.extra["auths"]; ok {
+		if err := json.Unmarshal(raw, &store.Auths); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal auths in '%s': %w", path, err)
+		}
+		delete(store.extra, "auths")
+	}
+	return store, nil
+}
+
+func (s *CredentialStore) Save() error {
+	out := make(map[string]interface{}, len(s.extra)+1)
+	for k, v := range s.extra {
+		out[k] = v
+	}
+	out["auths"] = s.Auths
+
+	configBytes, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		return fmt.Errorf("failed to create credentials directory for '%s': %w", s.Path, err)
+	}
+
+	tmpPath := s.Path + ".tmp"
+	if err := os.WriteFile(tmpPath, configBytes, 0600); err != nil {
+		return fmt.Errorf("failed to write credentials file '%s': %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.Path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace credentials file '%s': %w", s.Path, err)
+	}
+	return nil
+}
+
+func (s *CredentialStore) Get(registry string) (*Credentials, bool) {
+	for _, key := range credentialLookupKeys(registry) {
+		entry, ok := s.Auths[key]
+		if !ok || entry.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			continue
+		}
+		username, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			continue
+		}
+		return &Credentials{Username: username, Password: password}, true
+	}
+	return nil, false
+}
+
+func (s *CredentialStore) Set(registry string, creds Credentials) {
+	for _, key := range credentialLookupKeys(registry) {
+		delete(s.Auths, key)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+	s.Auths[CredentialKey(registry)] = AuthEntry{Auth: auth}
+}
+
+func (s *CredentialStore) Remove(registry string) bool {
+	removed := false
+	for _, key := range credentialLookupKeys(registry) {
+		if _, ok := s.Auths[key]; ok {
+			delete(s.Auths, key)
+			removed = true
+		}
+	}
+	return removed
+}
+
+func CredentialKey(registry string) string {
+	switch registry {
+	case "", DockerHubHost, "index.docker.io", DockerHubRegistry, dockerHubAuthKey:
+		return dockerHubAuthKey
+	}
+	return registry
+}
+
+func credentialLookupKeys(registry string) []string {
+	key := CredentialKey(registry)
+	if key == dockerHubAuthKey {
+		return []string{dockerHubAuthKey, "index.docker.io", DockerHubHost, DockerHubRegistry}
+	}
+	return []string{key, "https://" + key, "http://" + key}
+}
+
+// LookupCredentials returns stored credentials for a registry host, checking
+// the runtime's own credentials file first and ~/.docker/config.json second.
+func LookupCredentials(registry string) *Credentials {
+	var paths []string
+	if path, err := DefaultCredentialsPath(); err == nil {
+		paths = append(paths, path)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".docker", "config.json"))
+	}
+
+	for _, path := range paths {
+		store, err := LoadCredentialStore(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			continue
+		}
+		if creds, ok := store.Get(registry); ok {
+			return creds
+		}
+	}
+	return nil
+}
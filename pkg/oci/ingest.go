@@ -0,0 +1,160 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Blobs are downloaded into ingest/<algorithm>/<encoded> and only renamed
+// into blobs/ once their digest has been verified, so an interrupted pull
+// never exposes partial content and the next pull can pick up where the
+// previous one stopped.
+const ingestDir = "ingest"
+
+// BlobFetcher returns the content of a blob starting at offset. Sources that
+// cannot resume return the whole blob and report a start of 0.
+type BlobFetcher func(offset int64) (body io.ReadCloser, start int64, err error)
+
+func (s *Store) ingestPath(dgst digest.Digest) string {
+	return filepath.Join(s.Root, ingestDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// openIngest opens and locks the partial file for dgst. It returns nil when
+// another process committed the blob while this one was waiting for the lock.
+func (s *Store) openIngest(dgst digest.Digest) (*os.File, error) {
+	path := s.ingestPath(dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create ingest directory for %s: %w", dgst, err)
+	}
+
+	for {
+		if s.HasBlob(dgst) {
+			return nil, nil
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ingest file for %s: %w", dgst, err)
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock ingest file for %s: %w", dgst, err)
+		}
+		// The previous holder may have committed or discarded the file while
+		// we were waiting; only keep a lock on the file still at path.
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to stat ingest file for %s: %w", dgst, err)
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+// IngestBlobResumable downloads dgst into the store through fetch, resuming
+// from any partial data a previous attempt left behind. The complete content,
+// including the resumed prefix, is verified against dgst (and size, unless
+// it is negative) and copied to w when w is not nil, so callers can process
+// the blob while it streams in. Partial data is kept when the transfer
+// fails, and discarded when it does not match the digest.
+func (s *Store) IngestBlobResumable(dgst digest.Digest, size int64, fetch BlobFetcher, w io.Writer) error {
+	if w == nil {
+		w = io.Discard
+	}
+
+	f, err := s.openIngest(dgst)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return copyBlob(s, dgst, w)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat ingest file for %s: %w", dgst, err)
+	}
+	offset := info.Size()
+	if size >= 0 && offset > size {
+		offset = 0
+	}
+
+	var body io.Reader = eofReader{}
+	if size < 0 || offset < size {
+		rc, start, err := fetch(offset)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if start != offset {
+			// The source ignored the range request and restarted from 0.
+			offset = 0
+		}
+		body = rc
+	}
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate ingest file for %s: %w", dgst, err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek ingest file for %s: %w", dgst, err)
+	}
+
+	content := io.MultiReader(io.NewSectionReader(f, 0, offset), io.TeeReader(body, f))
+	verifier, err := newVerifyingReader(content, "blob", dgst, size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, verifier); err != nil {
+		return fmt.Errorf("failed to download blob %s (%d bytes kept for resume): %w", dgst, verifier.read, err)
+	}
+	if err := verifier.check(); err != nil {
+		os.Remove(s.ingestPath(dgst))
+		return err
+	}
+
+	return s.commitIngest(dgst, f)
+}
+
+func (s *Store) commitIngest(dgst digest.Digest, f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync blob %s: %w", dgst, err)
+	}
+	if err := f.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to chmod blob %s: %w", dgst, err)
+	}
+	blobPath := s.BlobPath(dgst)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return fmt.Errorf("failed to create blob directory for '%s': %w", blobPath, err)
+	}
+	if err := os.Rename(s.ingestPath(dgst), blobPath); err != nil {
+		return fmt.Errorf("failed to move blob %s into place: %w", dgst, err)
+	}
+	return nil
+}
+
+func copyBlob(s *Store, dgst digest.Digest, w io.Writer) error {
+	if w == io.Discard {
+		return nil
+	}
+	f, err := os.Open(s.BlobPath(dgst))
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %w", dgst, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", dgst, err)
+	}
+	return nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
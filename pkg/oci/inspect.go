@@ -0,0 +1,161 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImageInspect is what `image inspect` prints. Field names follow
+// `docker image inspect` where there is an equivalent; ID is the image's
+// digest in the store, as shown by `list --images`.
+type ImageInspect struct {
+	ID             digest.Digest     `json:"Id"`
+	RepoTags       []string          `json:"RepoTags"`
+	MediaType      string            `json:"MediaType"`
+	ManifestDigest digest.Digest     `json:"ManifestDigest"`
+	ConfigDigest   digest.Digest     `json:"ConfigDigest"`
+	Created        string            `json:"Created,omitempty"`
+	Author         string            `json:"Author,omitempty"`
+	Os             string            `json:"Os"`
+	Architecture   string            `json:"Architecture"`
+	Variant        string            `json:"Variant,omitempty"`
+	Config         json.RawMessage   `json:"Config,omitempty"`
+	Labels         map[string]string `json:"Labels"`
+	Layers         []LayerInspect    `json:"Layers"`
+	Size           int64             `json:"Size"`
+}
+
+type LayerInspect struct {
+	Digest    digest.Digest `json:"Digest"`
+	DiffID    digest.Digest `json:"DiffID,omitempty"`
+	MediaType string        `json:"MediaType"`
+	Size      int64         `json:"Size"`
+}
+
+// HistoryEntry is one step of an image's build history. Size and Layer are
+// those of the layer the step produced; empty layer steps have neither.
+type HistoryEntry struct {
+	Created    string        `json:"Created,omitempty"`
+	CreatedBy  string        `json:"CreatedBy"`
+	Comment    string        `json:"Comment,omitempty"`
+	EmptyLayer bool          `json:"EmptyLayer"`
+	Size       int64         `json:"Size"`
+	Layer      digest.Digest `json:"Layer,omitempty"`
+}
+
+func readImage(store *Store, manifestDigest digest.Digest) (*OciManifest, *OciConfig, []byte, error) {
+	manifestBytes, err := store.ReadBlob(manifestDigest)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var manifest OciManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unmarshal manifest %s: %w", manifestDigest, err)
+	}
+	configBytes, err := store.ReadBlob(manifest.Config.Digest)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var config OciConfig
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unmarshal config %s: %w", manifest.Config.Digest, err)
+	}
+	return &manifest, &config, configBytes, nil
+}
+
+// InspectImage describes the image desc points at, using the manifest for
+// platform when desc is a multi-platform index.
+func InspectImage(store *Store, desc specs.Descriptor, platform specs.Platform) (*ImageInspect, error) {
+	manifestDigest, err := store.PlatformManifest(desc, platform)
+	if err != nil {
+		return nil, err
+	}
+	manifest, config, configBytes, err := readImage(store, manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the runtime config verbatim: OciConfig still drops fields such
+	// as Healthcheck, OnBuild or Shell, and re-encoding it would reorder the
+	// rest and omit empty values.
+	var raw struct {
+		Config json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(configBytes, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config %s: %w", manifest.Config.Digest, err)
+	}
+
+	tags, err := store.TagsOf(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	inspect := &ImageInspect{
+		ID:             desc.Digest,
+		RepoTags:       []string{},
+		MediaType:      desc.MediaType,
+		ManifestDigest: manifestDigest,
+		ConfigDigest:   manifest.Config.Digest,
+		Author:         config.Author,
+		Os:             config.OS,
+		Architecture:   config.Architecture,
+		Variant:        config.Variant,
+		Config:         raw.Config,
+		Labels:         config.Config.Labels,
+		Layers:         []LayerInspect{},
+	}
+	if config.Created != nil {
+		inspect.Created = *config.Created
+	}
+	for _, tag := range tags {
+		inspect.RepoTags = append(inspect.RepoTags, tag.String())
+	}
+	for i, layer := range manifest.Layers {
+		layerInspect := LayerInspect{Digest: layer.Digest, MediaType: layer.MediaType, Size: layer.Size}
+		if i < len(config.RootFS.DiffIDs) {
+			layerInspect.DiffID = digest.Digest(config.RootFS.DiffIDs[i])
+		}
+		inspect.Layers = append(inspect.Layers, layerInspect)
+		inspect.Size += layer.Size
+	}
+	return inspect, nil
+}
+
+// ImageHistory pairs the config's history with the manifest's layers, oldest
+// step first. Every history entry that is not an empty_layer step produced
+// the next layer. Images built without history get one entry per layer.
+func ImageHistory(store *Store, manifestDigest digest.Digest) ([]HistoryEntry, error) {
+	manifest, config, _, err := readImage(store, manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []HistoryEntry
+	if len(config.History) == 0 {
+		for _, layer := range manifest.Layers {
+			entries = append(entries, HistoryEntry{Size: layer.Size, Layer: layer.Digest})
+		}
+		return entries, nil
+	}
+
+	layerIndex := 0
+	for _, h := range config.History {
+		entry := HistoryEntry{CreatedBy: h.CreatedBy, Comment: h.Comment, EmptyLayer: h.EmptyLayer}
+		if h.Created != nil {
+			entry.Created = *h.Created
+		}
+		if !h.EmptyLayer && layerIndex < len(manifest.Layers) {
+			entry.Size = manifest.Layers[layerIndex].Size
+			entry.Layer = manifest.Layers[layerIndex].Digest
+			layerIndex++
+		}
+		entries = append(entries, entry)
+	}
+	if layerIndex != len(manifest.Layers) {
+		fmt.Fprintf(os.Stderr, "warning: history of %s describes %d layers but the manifest has %d\n", manifestDigest, layerIndex, len(manifest.Layers))
+	}
+	return entries, nil
+}
@@ -0,0 +1,261 @@
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+// layerWriter turns changes into tar entries read from root, the tree
+// holding the new content (an overlay upper directory or a copy-mode
+// rootfs). Parent directories are only written when they are changes
+// themselves, so unchanged directories keep the owner and mode the lower
+// layers give them. Files hardlinked to each other become tar hardlinks.
+type layerWriter struct {
+	tw      *tar.Writer
+	root    string
+	opts    LayerOptions
+	written map[string]bool
+	inodes  map[uint64]string
+}
+
+// LayerOptions controls how a layer is produced. Entries are always written
+// in path order without user/group names, access or change times, so with
+// SourceDateEpoch and a fixed owner set the same content always yields the
+// same diff_id and blob digest.
+type LayerOptions struct {
+	// IDMaps translates file owners from host IDs back to container IDs.
+	IDMaps run.IDMappings
+	// UID and GID, when set, replace the owner of every entry.
+	UID, GID *int
+	// SourceDateEpoch, when set, replaces the modification time of every
+	// entry.
+	SourceDateEpoch *time.Time
+	// CacheKey, when set, looks the layer up in the store's layer cache
+	// before reading root and records it there once written. The key must
+	// identify the layer's content, e.g. a hash of the files it is made of.
+	CacheKey string
+}
+
+// SourceDateEpoch returns the time set in the SOURCE_DATE_EPOCH environment
+// variable, or nil when it is unset.
+func SourceDateEpoch() (*time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH '%s': %w", value, err)
+	}
+	epoch := time.Unix(seconds, 0).UTC()
+	return &epoch, nil
+}
+
+// WriteLayer writes changes as an uncompressed OCI layer to w.
+func WriteLayer(w io.Writer, root string, changes []Change, opts LayerOptions) error {
+	lw := &layerWriter{
+		tw:      tar.NewWriter(w),
+		root:    root,
+		opts:    opts,
+		written: make(map[string]bool),
+		inodes:  make(map[uint64]string),
+	}
+
+	sorted := append([]Change(nil), changes...)
+	sortChanges(sorted)
+	deleted := make(map[string]bool)
+	for _, change := range sorted {
+		if change.Kind == ChangeDelete {
+			if deletedAncestor(change.Path, deleted) {
+				continue
+			}
+			deleted[change.Path] = true
+			if err := lw.writeWhiteout(change.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := lw.writeEntry(change.Path); err != nil {
+			return err
+		}
+	}
+
+	if err := lw.tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish layer: %w", err)
+	}
+	return nil
+}
+
+func deletedAncestor(p string, deleted map[string]bool) bool {
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		if deleted[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+func (lw *layerWriter) writeWhiteout(p string) error {
+	// A deleted path below something that is no longer a directory was
+	// removed along with it; the replacement entry covers it.
+	info, err := os.Lstat(filepath.Join(lw.root, path.Dir(p)))
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	name := strings.TrimPrefix(path.Join(path.Dir(p), whiteoutPrefix+path.Base(p)), "/")
+	header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, ModTime: info.ModTime()}
+	if lw.opts.SourceDateEpoch != nil {
+		header.ModTime = *lw.opts.SourceDateEpoch
+	}
+	if err := lw.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write whiteout for '%s': %w", p, err)
+	}
+	return nil
+}
+
+func (lw *layerWriter) writeEntry(p string) error {
+	if lw.written[p] {
+		return nil
+	}
+	lw.written[p] = true
+
+	fullPath := filepath.Join(lw.root, p)
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat '%s': %w", fullPath, err)
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(fullPath); err != nil {
+			return fmt.Errorf("failed to read symlink '%s': %w", fullPath, err)
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("failed to create tar header for '%s': %w", fullPath, err)
+	}
+	header.Name = strings.TrimPrefix(p, "/")
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.Uname, header.Gname = "", ""
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	if lw.opts.SourceDateEpoch != nil {
+		header.ModTime = *lw.opts.SourceDateEpoch
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if uid, ok := lw.opts.IDMaps.ContainerUID(int(st.Uid)); ok {
+			header.Uid = uid
+		}
+		if gid, ok := lw.opts.IDMaps.ContainerGID(int(st.Gid)); ok {
+			header.Gid = gid
+		}
+		if info.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := lw.inodes[st.Ino]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				lw.inodes[st.Ino] = header.Name
+			}
+		}
+	}
+
+	if lw.opts.UID != nil {
+		header.Uid = *lw.opts.UID
+	}
+	if lw.opts.GID != nil {
+		header.Gid = *lw.opts.GID
+	}
+
+	for name, value := range listXattrs(fullPath) {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[paxXattrPrefix+name] = string(value)
+	}
+	if header.PAXRecords != nil {
+		header.Format = tar.FormatPAX
+	}
+
+	if err := lw.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for '%s': %w", p, err)
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", fullPath, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(lw.tw, f); err != nil {
+		return fmt.Errorf("failed to write '%s' to layer: %w", p, err)
+	}
+	return nil
+}
+
+// CreateLayer writes changes from root as a gzip compressed layer blob into
+// the store and returns its descriptor along with its diff_id.
+func CreateLayer(store *Store, root string, changes []Change, opts LayerOptions) (specs.Descriptor, digest.Digest, error) {
+	if opts.CacheKey != "" {
+		if desc, diffID, ok := store.CachedLayer(opts.CacheKey); ok {
+			return desc, diffID, nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(store.Root, ingestDir), 0755); err != nil {
+		return specs.Descriptor{}, "", fmt.Errorf("failed to create ingest directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Join(store.Root, ingestDir), "layer-")
+	if err != nil {
+		return specs.Descriptor{}, "", fmt.Errorf("failed to create layer file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	blobDigester := digest.Canonical.Digester()
+	diffIDDigester := digest.Canonical.Digester()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, blobDigester.Hash()))
+	if err := WriteLayer(io.MultiWriter(gz, diffIDDigester.Hash()), root, changes, opts); err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return specs.Descriptor{}, "", fmt.Errorf("failed to compress layer: %w", err)
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return specs.Descriptor{}, "", fmt.Errorf("failed to size layer file: %w", err)
+	}
+	desc := specs.Descriptor{MediaType: specs.MediaTypeImageLayerGzip, Digest: blobDigester.Digest(), Size: size}
+	if !store.reuseBlob(desc.Digest) {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return specs.Descriptor{}, "", fmt.Errorf("failed to rewind layer file: %w", err)
+		}
+		if err := store.IngestBlob(desc.Digest, desc.Size, tmp); err != nil {
+			return specs.Descriptor{}, "", err
+		}
+	}
+	diffID := diffIDDigester.Digest()
+	if opts.CacheKey != "" {
+		if err := store.CacheLayer(opts.CacheKey, desc, diffID); err != nil {
+			return specs.Descriptor{}, "", err
+		}
+	}
+	return desc, diffID, nil
+}
@@ -0,0 +1,98 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layers produced by CreateLayer are remembered in layercache/, one file
+// per caller-supplied key (named by the key's digest), so producing the same
+// content again reuses the stored blob instead of writing it again.
+const layerCacheDir = "layercache"
+
+type layerCacheEntry struct {
+	Key    string           `json:"key"`
+	Layer  specs.Descriptor `json:"layer"`
+	DiffID digest.Digest    `json:"diff_id"`
+}
+
+func (s *Store) layerCachePath(key string) string {
+	return filepath.Join(s.Root, layerCacheDir, digest.FromString(key).Encoded()+".json")
+}
+
+// CachedLayer returns the layer recorded under key, provided its blob is
+// still in the store.
+func (s *Store) CachedLayer(key string) (specs.Descriptor, digest.Digest, bool) {
+	entryBytes, err := os.ReadFile(s.layerCachePath(key))
+	if err != nil {
+		return specs.Descriptor{}, "", false
+	}
+	var entry layerCacheEntry
+	if err := json.Unmarshal(entryBytes, &entry); err != nil || entry.Key != key {
+		return specs.Descriptor{}, "", false
+	}
+	if entry.Layer.Digest.Validate() != nil || entry.DiffID.Validate() != nil || !s.reuseBlob(entry.Layer.Digest) {
+		return specs.Descriptor{}, "", false
+	}
+	return entry.Layer, entry.DiffID, true
+}
+
+// CacheLayer records layer under key.
+func (s *Store) CacheLayer(key string, layer specs.Descriptor, diffID digest.Digest) error {
+	entryBytes, err := json.Marshal(layerCacheEntry{Key: key, Layer: layer, DiffID: diffID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal layer cache entry: %w", err)
+	}
+	path := s.layerCachePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create layer cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".entry-")
+	if err != nil {
+		return fmt.Errorf("failed to write layer cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(entryBytes); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write layer cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write layer cache entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write layer cache entry '%s': %w", path, err)
+	}
+	return nil
+}
+
+// pruneLayerCache drops the cache entries whose blob is gone.
+func (s *Store) pruneLayerCache() error {
+	dir := filepath.Join(s.Root, layerCacheDir)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read layer cache directory '%s': %w", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		entryBytes, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var cached layerCacheEntry
+		if json.Unmarshal(entryBytes, &cached) == nil && cached.Layer.Digest.Validate() == nil && s.HasBlob(cached.Layer.Digest) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove layer cache entry '%s': %w", path, err)
+		}
+	}
+	return nil
+}
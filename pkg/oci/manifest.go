@@ -40,33 +40,37 @@ type OciConfig struct {
 	OSVersion    string   `json:"os.version,omitempty"`
 	OSFeatures   []string `json:"os.features,omitempty"`
 	Config       struct {
-		Hostname     string            `json:"Hostname,omitempty"`
-		Domainname   string            `json:"Domainname,omitempty"`
-		User         string            `json:"User,omitempty"`
-		AttachStdin  bool              `json:"AttachStdin,omitempty"`
-		AttachStdout bool              `json:"AttachStdout,omitempty"`
-		AttachStderr bool              `json:"AttachStderr,omitempty"`
-		Tty          bool              `json:"Tty,omitempty"`
-		OpenStdin    bool              `json:"OpenStdin,omitempty"`
-		StdinOnce    bool              `json:"StdinOnce,omitempty"`
-		Env          []string          `json:"Env,omitempty"`
-		Cmd          []string          `json:"Cmd,omitempty"`
-		Entrypoint   []string          `json:"Entrypoint,omitempty"`
-		Labels       map[string]string `json:"Labels,omitempty"`
-		WorkingDir   string            `json:"WorkingDir,omitempty"`
-		StopSignal   string            `json:"StopSignal,omitempty"`
+		Hostname     string              `json:"Hostname,omitempty"`
+		Domainname   string              `json:"Domainname,omitempty"`
+		User         string              `json:"User,omitempty"`
+		AttachStdin  bool                `json:"AttachStdin,omitempty"`
+		AttachStdout bool                `json:"AttachStdout,omitempty"`
+		AttachStderr bool                `json:"AttachStderr,omitempty"`
+		Tty          bool                `json:"Tty,omitempty"`
+		OpenStdin    bool                `json:"OpenStdin,omitempty"`
+		StdinOnce    bool                `json:"StdinOnce,omitempty"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+		Env          []string            `json:"Env,omitempty"`
+		Cmd          []string            `json:"Cmd,omitempty"`
+		Entrypoint   []string            `json:"Entrypoint,omitempty"`
+		Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+		Labels       map[string]string   `json:"Labels,omitempty"`
+		WorkingDir   string              `json:"WorkingDir,omitempty"`
+		StopSignal   string              `json:"StopSignal,omitempty"`
 	} `json:"config,omitempty"`
 	RootFS struct {
 		Type    string   `json:"type"`
 		DiffIDs []string `json:"diff_ids"`
 	} `json:"rootfs"`
-	History []struct {
-		Created    *string `json:"created,omitempty"`
-		CreatedBy  string  `json:"created_by,omitempty"`
-		Author     string  `json:"author,omitempty"`
-		Comment    string  `json:"comment,omitempty"`
-		EmptyLayer bool    `json:"empty_layer,omitempty"`
-	} `json:"history,omitempty"`
+	History []OciHistory `json:"history,omitempty"`
+}
+
+type OciHistory struct {
+	Created    *string `json:"created,omitempty"`
+	CreatedBy  string  `json:"created_by,omitempty"`
+	Author     string  `json:"author,omitempty"`
+	Comment    string  `json:"comment,omitempty"`
+	EmptyLayer bool    `json:"empty_layer,omitempty"`
 }
 
 type DockerManifest struct {
@@ -75,7 +79,7 @@ type DockerManifest struct {
 	Layers   []string `json:"Layers"`
 }
 
-func GetImageManifestDigest(imagePath string) (string, error) {
+func GetImageManifestDigest(imagePath string, platform specs.Platform) (string, error) {
 	manifestPath := filepath.Join(imagePath, "manifest.json")
 	if _, err := os.Stat(manifestPath); err == nil {
 		manifestBytes, err := os.ReadFile(manifestPath)
@@ -113,7 +117,27 @@ func GetImageManifestDigest(imagePath string) (string, error) {
 		if len(index.Manifests) == 0 {
 			return "", fmt.Errorf("no manifests found in index file '%s'", indexPath)
 		}
-		return index.Manifests[0].Digest.String(), nil
+
+		for {
+			desc, err := SelectManifest(index, platform)
+			if err != nil {
+				return "", fmt.Errorf("failed to select manifest from '%s': %w", indexPath, err)
+			}
+			if !IsIndexMediaType(desc.MediaType) {
+				return desc.Digest.String(), nil
+			}
+
+			nestedPath := filepath.Join(imagePath, "blobs", "sha256", DigestToFilename(desc.Digest.String()))
+			nestedBytes, err := os.ReadFile(nestedPath)
+			if err != nil {
+				return "", fmt.Errorf("failed to read nested index '%s': %w", nestedPath, err)
+			}
+			index = OciIndex{}
+			if err := json.Unmarshal(nestedBytes, &index); err != nil {
+				return "", fmt.Errorf("failed to unmarshal nested index '%s': %w", nestedPath, err)
+			}
+			indexPath = nestedPath
+		}
 	}
 
 	entries, err := os.ReadDir(imagePath)
@@ -176,7 +200,7 @@ func ReadManifest(imagePath, manifestDigestOrFilename string) (*OciManifest, err
 		for i, layerPath := range layerPaths {
 			layerDir := filepath.Dir(layerPath)
 			syntheticManifest.Layers[i] = specs.Descriptor{
-				MediaType: specs.MediaTypeImageLayerGzip,
+				MediaType: specs.MediaTypeImageLayer,
 				Digest:    digest.Digest("sha256:" + layerDir),
 			}
 		}
@@ -221,7 +245,7 @@ func ReadManifest(imagePath, manifestDigestOrFilename string) (*OciManifest, err
 			MediaType:     specs.MediaTypeImageManifest,
 			Config: specs.Descriptor{
 				MediaType: specs.MediaTypeImageConfig,
-				Digest:    digest.Digest("sha256:" + strings.TrimSuffix(manifestDigestOrFilename, ".json")),
+				Digest:    digest.Digest("sha256:" + strings.TrimSuffix(filepath.Base(manifestDigestOrFilename), ".json")),
 			},
 			Layers: make([]specs.Descriptor, len(dockerManifest.Layers)),
 		}
@@ -239,7 +263,7 @@ func ReadManifest(imagePath, manifestDigestOrFilename string) (*OciManifest, err
 			}
 			layerDigestHex = strings.Trim(layerDigestHex, "/")
 			ociManifest.Layers[i] = specs.Descriptor{
-				MediaType: specs.MediaTypeImageLayerGzip,
+				MediaType: specs.MediaTypeImageLayer,
 				Digest:    digest.Digest("sha256:" + layerDigestHex),
 			}
 		}
@@ -259,6 +283,12 @@ func ReadManifest(imagePath, manifestDigestOrFilename string) (*OciManifest, err
 		return nil, fmt.Errorf("failed to read OCI manifest file '%s': %w", ociManifestPath, readErr)
 	}
 
+	if strings.Contains(manifestDigestOrFilename, ":") {
+		if err := verifyContent("manifest", digest.Digest(manifestDigestOrFilename), ociManifestBytes); err != nil {
+			return nil, err
+		}
+	}
+
 	var manifest OciManifest
 	if err := json.Unmarshal(ociManifestBytes, &manifest); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal OCI manifest file '%s': %w", ociManifestPath, err)
@@ -297,6 +327,15 @@ func ReadConfig(imagePath, configDigestOrFilename string) (*OciConfig, error) {
 	}
 
 	ociConfigFilename := DigestToFilename(configDigestOrFilename)
+	dockerConfigPath := filepath.Join(imagePath, ociConfigFilename+".json")
+	if configBytes, err := os.ReadFile(dockerConfigPath); err == nil {
+		var config OciConfig
+		if err := json.Unmarshal(configBytes, &config); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal Docker config file '%s': %w", dockerConfigPath, err)
+		}
+		return &config, nil
+	}
+
 	ociConfigPath := filepath.Join(imagePath, "blobs", "sha256", ociConfigFilename)
 	ociConfigBytes, readErr := os.ReadFile(ociConfigPath)
 	if readErr != nil {
@@ -306,6 +345,12 @@ func ReadConfig(imagePath, configDigestOrFilename string) (*OciConfig, error) {
 		return nil, fmt.Errorf("failed to read OCI config file '%s': %w", ociConfigPath, readErr)
 	}
 
+	if strings.Contains(configDigestOrFilename, ":") {
+		if err := verifyContent("config", digest.Digest(configDigestOrFilename), ociConfigBytes); err != nil {
+			return nil, err
+		}
+	}
+
 	var config OciConfig
 	if err := json.Unmarshal(ociConfigBytes, &config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal OCI config file '%s': %w", ociConfigPath, err)
@@ -324,39 +369,16 @@ func MapOciConfigToRunConfig(ociCgg *OciConfig, rootfsPath string) (*run.ImageCo
 		args = ociCgg.Config.Cmd
 	}
 
-	uid, gid := 0, 0
-
-	if ociCgg.Config.User != "" {
-		parts := strings.SplitN(ociCgg.Config.User, ":", 2)
-		if len(parts) > 0 {
-			var err error
-			uid, err = parseIntOrDefault(parts[0], 0)
-			if err != nil {
-				return nil, fmt.Errorf("invalid UID: %w", err)
-			}
-		}
-		if len(parts) > 1 {
-			var err error
-			gid, err = parseIntOrDefault(parts[1], 0)
-			if err != nil {
-				return nil, fmt.Errorf("invalid GID: %w", err)
-			}
-		} else {
-			gid = uid
-		}
-	}
-
 	runCfg := &run.ImageConfig{
 		Hostname: ociCgg.Config.Hostname,
 		Root:     run.RootConfig{Path: rootfsPath},
 		ProcessConfig: run.ProcessConfig{
-			Env:  ociCgg.Config.Env,
-			Args: args,
-			Cwd:  ociCgg.Config.WorkingDir,
-			User: map[string]int{
-				"uid": uid,
-				"gid": gid,
-			},
+			Env:             ociCgg.Config.Env,
+			Args:            args,
+			Cwd:             ociCgg.Config.WorkingDir,
+			User:            run.User{Username: ociCgg.Config.User},
+			Capabilities:    run.DefaultCapabilities(),
+			NoNewPrivileges: true,
 		},
 	}
 	if runCfg.ProcessConfig.Cwd == "" {
@@ -369,18 +391,6 @@ func MapOciConfigToRunConfig(ociCgg *OciConfig, rootfsPath string) (*run.ImageCo
 	return runCfg, nil
 }
 
-func parseIntOrDefault(s string, defaultVal int) (int, error) {
-	if s == "" {
-		return defaultVal, nil
-	}
-	val := 0
-	_, err := fmt.Sscanf(s, "%d", &val)
-	if err != nil {
-		return defaultVal, err
-	}
-	return val, nil
-}
-
 func DigestToFilename(digest string) string {
 	parts := strings.SplitN(digest, ":", 2)
 	if len(parts) == 2 {
@@ -0,0 +1,168 @@
+package oci
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	annotationDockerReferenceType = "vnd.docker.reference.type"
+	attestationManifestType       = "attestation-manifest"
+)
+
+func HostPlatform() specs.Platform {
+	platform := specs.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	switch runtime.GOARCH {
+	case "arm64":
+		platform.Variant = "v8"
+	case "arm":
+		platform.Variant = "v7"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "GOARM" && setting.Value != "" {
+					platform.Variant = "v" + strings.SplitN(setting.Value, ",", 2)[0]
+				}
+			}
+		}
+	}
+	return platform
+}
+
+func ParsePlatform(s string) (specs.Platform, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return specs.Platform{}, fmt.Errorf("invalid platform '%s': expected os/arch[/variant]", s)
+	}
+	platform := specs.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return NormalizePlatform(platform), nil
+}
+
+func NormalizePlatform(platform specs.Platform) specs.Platform {
+	platform.OS = strings.ToLower(platform.OS)
+	platform.Architecture = strings.ToLower(platform.Architecture)
+	platform.Variant = strings.ToLower(platform.Variant)
+
+	switch platform.Architecture {
+	case "x86_64", "x86-64":
+		platform.Architecture = "amd64"
+		platform.Variant = ""
+	case "i386", "i686":
+		platform.Architecture = "386"
+	case "aarch64":
+		platform.Architecture = "arm64"
+	case "armhf":
+		platform.Architecture = "arm"
+		platform.Variant = "v7"
+	case "armel":
+		platform.Architecture = "arm"
+		platform.Variant = "v6"
+	}
+
+	switch platform.Architecture {
+	case "arm64":
+		if platform.Variant == "8" || platform.Variant == "" {
+			platform.Variant = "v8"
+		}
+	case "arm":
+		if platform.Variant == "" {
+			platform.Variant = "v7"
+		} else if !strings.HasPrefix(platform.Variant, "v") {
+			platform.Variant = "v" + platform.Variant
+		}
+	}
+	return platform
+}
+
+func FormatPlatform(platform specs.Platform) string {
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+// platformScore reports how well an image platform fits the wanted one: 0 is
+// no match, higher is better. ARM variants are backwards compatible, so a v7
+// host can still run v6 images, just with lower preference.
+func platformScore(want, have specs.Platform) int {
+	want = NormalizePlatform(want)
+	have = NormalizePlatform(have)
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return 0
+	}
+	if want.Variant == have.Variant {
+		return 100
+	}
+	if want.Architecture == "arm" {
+		var wantV, haveV int
+		if _, err := fmt.Sscanf(want.Variant, "v%d", &wantV); err != nil {
+			return 0
+		}
+		if _, err := fmt.Sscanf(have.Variant, "v%d", &haveV); err != nil {
+			return 0
+		}
+		if haveV < wantV {
+			return 100 - (wantV - haveV)
+		}
+	}
+	return 0
+}
+
+func isSelectableManifest(desc specs.Descriptor) bool {
+	if desc.Annotations[annotationDockerReferenceType] == attestationManifestType {
+		return false
+	}
+	if desc.Platform != nil && (desc.Platform.OS == "unknown" || desc.Platform.Architecture == "unknown") {
+		return false
+	}
+	switch desc.MediaType {
+	case specs.MediaTypeImageManifest, MediaTypeDockerManifest, specs.MediaTypeImageIndex, MediaTypeDockerManifestList, "":
+		return true
+	}
+	return false
+}
+
+func SelectManifest(index OciIndex, platform specs.Platform) (specs.Descriptor, error) {
+	var best specs.Descriptor
+	bestScore := 0
+	var available []string
+
+	for _, desc := range index.Manifests {
+		if !isSelectableManifest(desc) {
+			continue
+		}
+		if desc.Platform == nil {
+			continue
+		}
+		available = append(available, FormatPlatform(NormalizePlatform(*desc.Platform)))
+		if score := platformScore(platform, *desc.Platform); score > bestScore {
+			best = desc
+			bestScore = score
+		}
+	}
+
+	if bestScore > 0 {
+		return best, nil
+	}
+	if len(available) == 0 {
+		// Indexes written without platform information (e.g. a local layout
+		// holding a single image) can only be used as-is.
+		for _, desc := range index.Manifests {
+			if isSelectableManifest(desc) {
+				return desc, nil
+			}
+		}
+		return specs.Descriptor{}, fmt.Errorf("index contains no image manifests")
+	}
+
+	sort.Strings(available)
+	return specs.Descriptor{}, fmt.Errorf("no manifest matches platform %s (available: %s)", FormatPlatform(NormalizePlatform(platform)), strings.Join(available, ", "))
+}
@@ -0,0 +1,118 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const progressRedrawInterval = 100 * time.Millisecond
+
+// pullProgress renders one status line per blob, like `docker pull`. On a
+// terminal the lines are redrawn in place; otherwise only status changes are
+// printed, so logs stay readable.
+type pullProgress struct {
+	mu       sync.Mutex
+	out      io.Writer
+	tty      bool
+	ids      []string
+	lines    map[string]string
+	drawn    int
+	lastDraw time.Time
+}
+
+func newPullProgress(out io.Writer) *pullProgress {
+	if out == nil {
+		out = os.Stdout
+	}
+	tty := false
+	if f, ok := out.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			tty = info.Mode()&os.ModeCharDevice != 0
+		}
+	}
+	return &pullProgress{out: out, tty: tty, lines: make(map[string]string)}
+}
+
+func progressID(dgst digest.Digest) string {
+	encoded := dgst.Encoded()
+	if len(encoded) > 12 {
+		encoded = encoded[:12]
+	}
+	return encoded
+}
+
+// set records a new status for a blob. Byte counters (transient) are only
+// shown on terminals, and redraws of them are rate limited.
+func (p *pullProgress) set(id, status string, transient bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.lines[id]; !ok {
+		p.ids = append(p.ids, id)
+	}
+	p.lines[id] = status
+
+	if !p.tty {
+		if !transient {
+			fmt.Fprintf(p.out, "%s: %s\n", id, status)
+		}
+		return
+	}
+	if transient && time.Since(p.lastDraw) < progressRedrawInterval {
+		return
+	}
+	p.redraw()
+}
+
+func (p *pullProgress) redraw() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA", p.drawn)
+	}
+	for _, id := range p.ids {
+		fmt.Fprintf(p.out, "\x1b[2K%s: %s\n", id, p.lines[id])
+	}
+	p.drawn = len(p.ids)
+	p.lastDraw = time.Now()
+}
+
+// progressReader reports how much of a blob has been read through it.
+type progressReader struct {
+	r        io.ReadCloser
+	progress *pullProgress
+	id       string
+	action   string
+	total    int64
+	read     int64
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.read += int64(n)
+	if n > 0 {
+		r.progress.set(r.id, fmt.Sprintf("%s %s/%s", r.action, FormatBytes(r.read), FormatBytes(r.total)), true)
+	}
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	return r.r.Close()
+}
+
+// FormatBytes renders n with a decimal unit suffix, e.g. 3.2MB.
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
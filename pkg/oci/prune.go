@@ -0,0 +1,205 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Blobs and snapshots younger than this are never pruned: a pull or run may
+// have just written them without having tagged its image or saved its
+// container config yet.
+const pruneGracePeriod = 10 * time.Minute
+
+type PruneResult struct {
+	Images         []specs.Descriptor
+	Blobs          []digest.Digest
+	SpaceReclaimed int64
+}
+
+// Prune removes untagged images (every image when all is set) whose digest
+// is not in inUse, then deletes every blob that no remaining image refers
+// to, along with the layer cache entries of deleted layers.
+func (s *Store) Prune(inUse map[digest.Digest]bool, all bool) (PruneResult, error) {
+	var result PruneResult
+
+	unlock, err := s.lock()
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+
+	index, err := s.readIndex()
+	if err != nil {
+		return result, err
+	}
+	kept := index.Manifests[:0]
+	for _, desc := range index.Manifests {
+		untagged := desc.Annotations[specs.AnnotationRefName] == ""
+		if (untagged || all) && !inUse[desc.Digest] {
+			result.Images = append(result.Images, desc)
+			continue
+		}
+		kept = append(kept, desc)
+	}
+	index.Manifests = kept
+	if err := s.writeIndex(index); err != nil {
+		return result, err
+	}
+
+	counts := s.refCounts(index)
+	blobDir := filepath.Join(s.Root, specs.ImageBlobsDir, digest.SHA256.String())
+	entries, err := os.ReadDir(blobDir)
+	if err != nil {
+		return result, fmt.Errorf("failed to read blob directory '%s': %w", blobDir, err)
+	}
+	for _, entry := range entries {
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, entry.Name())
+		if dgst.Validate() != nil || counts[dgst] > 0 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < pruneGracePeriod {
+			continue
+		}
+		if err := os.Remove(filepath.Join(blobDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return result, fmt.Errorf("failed to remove unreferenced blob %s: %w", dgst, err)
+		}
+		result.Blobs = append(result.Blobs, dgst)
+		result.SpaceReclaimed += info.Size()
+	}
+	if err := s.pruneLayerCache(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// LayerKeys returns the diff_ids and layer digests of every image in the
+// store, i.e. every key a snapshot in use by an image can have.
+func (s *Store) LayerKeys() (map[digest.Digest]bool, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[digest.Digest]bool)
+	var walk func(desc specs.Descriptor)
+	walk = func(desc specs.Descriptor) {
+		content, err := s.ReadBlob(desc.Digest)
+		if err != nil {
+			return
+		}
+		if IsIndexMediaType(desc.MediaType) {
+			var index OciIndex
+			if json.Unmarshal(content, &index) == nil {
+				for _, m := range index.Manifests {
+					walk(m)
+				}
+			}
+			return
+		}
+		var manifest OciManifest
+		if json.Unmarshal(content, &manifest) != nil {
+			return
+		}
+		for _, layer := range manifest.Layers {
+			keys[layer.Digest] = true
+		}
+		configBytes, err := s.ReadBlob(manifest.Config.Digest)
+		if err != nil {
+			return
+		}
+		var config OciConfig
+		if json.Unmarshal(configBytes, &config) != nil {
+			return
+		}
+		for _, diffID := range config.RootFS.DiffIDs {
+			keys[digest.Digest(diffID)] = true
+		}
+	}
+	for _, desc := range index.Manifests {
+		walk(desc)
+	}
+	return keys, nil
+}
+
+// Prune removes the snapshots whose key is not in keep and whose directory
+// is not listed in inUse (the overlay lowerdirs of existing containers),
+// along with leftovers of interrupted extractions. It returns the number of
+// bytes reclaimed.
+func (s *Snapshotter) Prune(keep map[digest.Digest]bool, inUse map[string]bool) (int64, error) {
+	dir := filepath.Join(s.Root, digest.SHA256.String())
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read snapshot directory '%s': %w", dir, err)
+	}
+
+	var reclaimed int64
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !strings.HasPrefix(entry.Name(), ".") {
+			if keep[digest.NewDigestFromEncoded(digest.SHA256, entry.Name())] {
+				continue
+			}
+			if abs, err := filepath.Abs(path); err == nil && inUse[abs] {
+				continue
+			}
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < pruneGracePeriod {
+			continue
+		}
+
+		size := diskUsage(path)
+		if err := removeSnapshot(path); err != nil {
+			return reclaimed, err
+		}
+		reclaimed += size
+	}
+	return reclaimed, nil
+}
+
+// removeSnapshot renames the snapshot out of the way first, so a partially
+// deleted tree is never mistaken for a complete snapshot. Layers may contain
+// read-only directories, which are made writable to be emptied.
+func removeSnapshot(path string) error {
+	trash := path
+	if !strings.HasPrefix(filepath.Base(path), ".") {
+		trash = filepath.Join(filepath.Dir(path), ".remove-"+filepath.Base(path))
+		if err := os.Rename(path, trash); err != nil {
+			return fmt.Errorf("failed to remove snapshot '%s': %w", path, err)
+		}
+	}
+	if err := os.RemoveAll(trash); err == nil {
+		return nil
+	}
+	filepath.Walk(trash, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(p, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(trash); err != nil {
+		return fmt.Errorf("failed to remove snapshot '%s': %w", path, err)
+	}
+	return nil
+}
+
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -1,57 +1,291 @@
 package oci
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
 )
 
-func PullImage(imageDir, image string) ([]byte, error) {
-	if err := os.MkdirAll(imageDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create directory %s: %w", imageDir, err)
-	}
+const DefaultMaxConcurrentDownloads = 3
+
+type PullOptions struct {
+	Platform specs.Platform
+	// MaxConcurrentDownloads limits how many layers are fetched at once;
+	// values below 1 mean DefaultMaxConcurrentDownloads.
+	MaxConcurrentDownloads int
+	// Snapshotter, when set, extracts every layer into its snapshot while it
+	// is being downloaded instead of leaving that to the first run.
+	Snapshotter *Snapshotter
+	// Progress receives the per-layer progress display (stdout when nil).
+	Progress io.Writer
+}
+
+func PullImage(store *Store, ref utiles.Reference, opts PullOptions) ([]byte, error) {
+	platform := opts.Platform
+	client := NewRegistryClient(ref.Registry)
+	client.Credentials = LookupCredentials(ref.Registry)
+	fmt.Printf("Pulling image %s (%s) from %s...\n", ref, FormatPlatform(platform), client.Host)
 
-	_, err := exec.LookPath("docker")
+	manifestBytes, mediaType, err := client.GetManifest(ref.Repository, ref.Identifier())
 	if err != nil {
-		return nil, fmt.Errorf("Docker CLI is required but not found: %w", err)
+		return nil, err
+	}
+	if ref.Digest != "" {
+		if actual := digest.FromBytes(manifestBytes); actual != ref.Digest {
+			return nil, fmt.Errorf("registry returned manifest %s for pinned reference '%s'", actual, ref)
+		}
 	}
+	mediaType = detectManifestMediaType(manifestBytes, mediaType)
 
-	fmt.Printf("Pulling image %s using Docker CLI...\n", image)
+	// The store's index.json points at whatever the tag resolved to, so a
+	// multi-arch image keeps its full index and other platforms can be
+	// pulled under the same name later.
+	rootDesc := specs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(manifestBytes),
+		Size:      int64(len(manifestBytes)),
+	}
+	rootBytes := manifestBytes
+
+	if IsIndexMediaType(mediaType) {
+		var index OciIndex
+		if err := json.Unmarshal(manifestBytes, &index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image index for '%s': %w", ref, err)
+		}
+		desc, err := SelectManifest(index, platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select manifest for '%s': %w", ref, err)
+		}
+		manifestBytes, mediaType, err = client.GetManifest(ref.Repository, desc.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyContent("manifest", desc.Digest, manifestBytes); err != nil {
+			return nil, err
+		}
+		mediaType = detectManifestMediaType(manifestBytes, mediaType)
+		if IsIndexMediaType(mediaType) {
+			return nil, fmt.Errorf("nested image index %s in '%s' is not supported", desc.Digest, ref)
+		}
+	}
 
-	pullCmd := exec.Command("docker", "pull", image)
-	pullCmd.Stdout = os.Stdout
-	pullCmd.Stderr = os.Stderr
-	if err := pullCmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to pull image using Docker CLI: %w", err)
+	var manifest OciManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest for '%s': %w", ref, err)
 	}
 
-	tempDir, err := os.MkdirTemp("", "container-with-go-")
+	// The config comes first: its diff_ids are needed to verify and
+	// snapshot the layers.
+	if store.reuseBlob(manifest.Config.Digest) {
+		fmt.Printf("Blob %s already exists, skipping\n", manifest.Config.Digest)
+	} else {
+		fmt.Printf("Fetching config %s (%d bytes)...\n", manifest.Config.Digest, manifest.Config.Size)
+		if err := fetchBlob(client, ref.Repository, manifest.Config, store); err != nil {
+			return nil, err
+		}
+	}
+	config, err := ReadConfig(store.Root, manifest.Config.Digest.String())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		return nil, err
+	}
+	warnPlatformMismatch(config, platform)
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("config of '%s' lists %d diff_ids but manifest has %d layers", ref, len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	layers := make([]Layer, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		layers[i] = Layer{
+			Path:      store.BlobPath(desc.Digest),
+			MediaType: desc.MediaType,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+			DiffID:    digest.Digest(config.RootFS.DiffIDs[i]),
+		}
+	}
+	if err := fetchLayers(client, ref.Repository, store, layers, opts); err != nil {
+		return nil, err
 	}
-	defer os.RemoveAll(tempDir)
 
-	tarPath := filepath.Join(tempDir, "image.tar")
-	saveCmd := exec.Command("docker", "save", "-o", tarPath, image)
-	saveCmd.Stdout = os.Stdout
-	saveCmd.Stderr = os.Stderr
-	if err := saveCmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to save image to tar: %w", err)
+	if err := store.WriteBlob(digest.FromBytes(manifestBytes), manifestBytes); err != nil {
+		return nil, err
+	}
+	if err := store.WriteBlob(rootDesc.Digest, rootBytes); err != nil {
+		return nil, err
 	}
+	if err := store.Tag(ref, rootDesc); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Image %s successfully pulled (%s)\n", ref, rootDesc.Digest)
+
+	return manifestBytes, nil
+}
 
-	if err := os.MkdirAll(imageDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create image directory: %w", err)
+func detectManifestMediaType(manifestBytes []byte, headerType string) string {
+	if headerType != "" && headerType != "application/json" && headerType != "text/plain" {
+		return headerType
+	}
+	var probe struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifestBytes, &probe); err == nil {
+		if probe.MediaType != "" {
+			return probe.MediaType
+		}
+		if probe.Manifests != nil {
+			return specs.MediaTypeImageIndex
+		}
 	}
+	return specs.MediaTypeImageManifest
+}
 
-	extractCmd := exec.Command("tar", "-xf", tarPath, "-C", imageDir)
-	extractCmd.Stdout = os.Stdout
-	extractCmd.Stderr = os.Stderr
-	if err := extractCmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to extract image tar: %w", err)
+func warnPlatformMismatch(config *OciConfig, platform specs.Platform) {
+	imagePlatform := specs.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	if platformScore(platform, imagePlatform) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: image platform %s does not match requested platform %s\n",
+			FormatPlatform(NormalizePlatform(imagePlatform)), FormatPlatform(NormalizePlatform(platform)))
 	}
+}
 
-	fmt.Printf("Image %s successfully pulled and extracted to %s\n", image, imageDir)
+// fetchLayers downloads the layers missing from the store, up to
+// opts.MaxConcurrentDownloads at a time. Layers are independent blobs (and
+// independent snapshots), so their order only matters later, when copy mode
+// stacks them into a single rootfs.
+func fetchLayers(client *RegistryClient, repository string, store *Store, layers []Layer, opts PullOptions) error {
+	limit := opts.MaxConcurrentDownloads
+	if limit < 1 {
+		limit = DefaultMaxConcurrentDownloads
+	}
+	progress := newPullProgress(opts.Progress)
 
-	return []byte{}, nil
+	var pending []Layer
+	seen := make(map[digest.Digest]bool)
+	for _, layer := range layers {
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+		pending = append(pending, layer)
+		progress.set(progressID(layer.Digest), "Waiting", false)
+	}
+
+	sem := make(chan struct{}, limit)
+	errs := make([]error, len(pending))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for i, layer := range pending {
+		wg.Add(1)
+		go func(i int, layer Layer) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			id := progressID(layer.Digest)
+			if failed.Load() {
+				progress.set(id, "Cancelled", false)
+				return
+			}
+			if err := fetchLayer(client, repository, store, layer, opts.Snapshotter, progress); err != nil {
+				failed.Store(true)
+				errs[i] = err
+				progress.set(id, "Failed", false)
+			}
+		}(i, layer)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchLayer(client *RegistryClient, repository string, store *Store, layer Layer, snapshotter *Snapshotter, progress *pullProgress) error {
+	id := progressID(layer.Digest)
+	needSnapshot := snapshotter != nil && !snapshotter.HasSnapshot(layer)
+
+	if store.reuseBlob(layer.Digest) {
+		if needSnapshot {
+			progress.set(id, "Extracting", false)
+			file, err := os.Open(layer.Path)
+			if err != nil {
+				return fmt.Errorf("failed to open layer file '%s': %w", layer.Path, err)
+			}
+			err = snapshotter.Extract(layer, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+		progress.set(id, "Already exists", false)
+		return nil
+	}
+
+	fetch := func(offset int64) (io.ReadCloser, int64, error) {
+		body, start, err := client.GetBlobFrom(repository, layer.Digest, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if start > 0 {
+			progress.set(id, "Resuming at "+FormatBytes(start), false)
+		} else {
+			progress.set(id, "Downloading", false)
+		}
+		return &progressReader{r: body, progress: progress, id: id, action: "Downloading", total: layer.Size, read: start}, start, nil
+	}
+
+	if !needSnapshot {
+		if err := store.IngestBlobResumable(layer.Digest, layer.Size, fetch, nil); err != nil {
+			return err
+		}
+		progress.set(id, "Download complete", false)
+		return nil
+	}
+
+	// The blob is teed into the unpacker, so decompression and extraction
+	// run while the download is still in flight.
+	pipeReader, pipeWriter := io.Pipe()
+	extractErr := make(chan error, 1)
+	go func() {
+		err := snapshotter.Extract(layer, pipeReader)
+		if err != nil {
+			pipeReader.CloseWithError(err)
+		}
+		extractErr <- err
+	}()
+
+	ingestErr := store.IngestBlobResumable(layer.Digest, layer.Size, fetch, pipeWriter)
+	pipeWriter.CloseWithError(ingestErr)
+	if ingestErr == nil {
+		progress.set(id, "Extracting", false)
+	}
+	// A failed extraction also aborts the ingest through the pipe, so the
+	// ingest error already describes whichever side failed first.
+	err := <-extractErr
+	if ingestErr != nil {
+		return ingestErr
+	}
+	if err != nil {
+		return err
+	}
+	progress.set(id, "Pull complete", false)
+	return nil
+}
+
+func fetchBlob(client *RegistryClient, repository string, desc specs.Descriptor, store *Store) error {
+	fetch := func(offset int64) (io.ReadCloser, int64, error) {
+		return client.GetBlobFrom(repository, desc.Digest, offset)
+	}
+	return store.IngestBlobResumable(desc.Digest, desc.Size, fetch, nil)
 }
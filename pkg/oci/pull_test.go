@@ -0,0 +1,199 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specsgo "github.com/opencontainers/image-spec/specs-go"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+)
+
+const testToken = "test-token"
+
+// testRegistry is a registry stand-in serving one image, test/app:v1, behind
+// a bearer token service.
+type testRegistry struct {
+	server         *httptest.Server
+	manifest       []byte
+	manifestDigest digest.Digest
+	blobs          map[digest.Digest][]byte
+	tokenRequests  atomic.Int32
+	scopes         chan string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	r := &testRegistry{blobs: make(map[digest.Digest][]byte), scopes: make(chan string, 16)}
+
+	var layerTar bytes.Buffer
+	tw := tar.NewWriter(&layerTar)
+	content := []byte("hello from the registry\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+	var layerGz bytes.Buffer
+	gz := gzip.NewWriter(&layerGz)
+	gz.Write(layerTar.Bytes())
+	gz.Close()
+	layerDigest := digest.FromBytes(layerGz.Bytes())
+	r.blobs[layerDigest] = layerGz.Bytes()
+
+	platform := HostPlatform()
+	config, err := json.Marshal(map[string]any{
+		"architecture": platform.Architecture,
+		"os":           platform.OS,
+		"variant":      platform.Variant,
+		"config":       map[string]any{"Cmd": []string{"/bin/sh"}},
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": []digest.Digest{digest.FromBytes(layerTar.Bytes())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest := digest.FromBytes(config)
+	r.blobs[configDigest] = config
+
+	r.manifest, err = json.Marshal(specs.Manifest{
+		Versioned: specsgo.Versioned{SchemaVersion: 2},
+		MediaType: specs.MediaTypeImageManifest,
+		Config:    specs.Descriptor{MediaType: specs.MediaTypeImageConfig, Digest: configDigest, Size: int64(len(config))},
+		Layers:    []specs.Descriptor{{MediaType: specs.MediaTypeImageLayerGzip, Digest: layerDigest, Size: int64(layerGz.Len())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.manifestDigest = digest.FromBytes(r.manifest)
+
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.tokenRequests.Add(1)
+		select {
+		case r.scopes <- req.URL.Query().Get("scope"):
+		default:
+		}
+		json.NewEncoder(w).Encode(map[string]any{"token": testToken, "expires_in": 300})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.server.URL+`/token",service="test-registry"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch path := req.URL.Path; {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "/v2/test/app/manifests/v1", path == "/v2/test/app/manifests/"+r.manifestDigest.String():
+		w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", r.manifestDigest.String())
+		w.Write(r.manifest)
+	case strings.HasPrefix(path, "/v2/test/app/blobs/"):
+		blob, ok := r.blobs[digest.Digest(strings.TrimPrefix(path, "/v2/test/app/blobs/"))]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(blob))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestPullImageFromTestRegistry(t *testing.T) {
+	// Keep the user's stored credentials out of the test.
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CONTAINER_AUTH_FILE", home+"/auth.json")
+
+	registry := newTestRegistry(t)
+	if err := NewRegistryClient(registry.host()).Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if scope := <-registry.scopes; scope != "" {
+		t.Errorf("ping asked for token scope %q, want none", scope)
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+	}{
+		{"by tag", registry.host() + "/test/app:v1"},
+		{"by digest", registry.host() + "/test/app@" + registry.manifestDigest.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := OpenStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := utiles.ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := registry.tokenRequests.Load()
+			if _, err := PullImage(store, ref, PullOptions{Platform: HostPlatform(), Progress: io.Discard}); err != nil {
+				t.Fatalf("PullImage(%s): %v", tt.ref, err)
+			}
+			if registry.tokenRequests.Load() == before {
+				t.Errorf("pull did not go through the bearer token flow")
+			}
+			if scope := <-registry.scopes; scope != "repository:test/app:pull" {
+				t.Errorf("token scope = %q, want %q", scope, "repository:test/app:pull")
+			}
+
+			desc, err := store.Resolve(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.Digest != registry.manifestDigest {
+				t.Errorf("store resolved %s to %s, want %s", tt.ref, desc.Digest, registry.manifestDigest)
+			}
+			manifest, err := ReadManifest(store.Root, desc.Digest.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, err := ReadConfig(store.Root, manifest.Config.Digest.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(manifest.Layers) != 1 || len(config.RootFS.DiffIDs) != 1 {
+				t.Fatalf("got %d layers and %d diff_ids, want 1 each", len(manifest.Layers), len(config.RootFS.DiffIDs))
+			}
+			for dgst, content := range registry.blobs {
+				stored, err := store.ReadBlob(dgst)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(stored, content) {
+					t.Errorf("blob %s differs from the registry's", dgst)
+				}
+			}
+			if err := VerifyImage(store, desc, io.Discard); err != nil {
+				t.Errorf("VerifyImage: %v", err)
+			}
+		})
+	}
+}
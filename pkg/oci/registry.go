@@ -0,0 +1,179 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	MediaTypeDockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	DockerHubHost     = "docker.io"
+	DockerHubRegistry = "registry-1.docker.io"
+)
+
+var manifestAcceptTypes = []string{
+	specs.MediaTypeImageManifest,
+	specs.MediaTypeImageIndex,
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+}
+
+type RegistryClient struct {
+	Host        string
+	PlainHTTP   bool
+	HTTPClient  *http.Client
+	Credentials *Credentials
+
+	basicAuth atomic.Bool
+	tokens    tokenCache
+}
+
+func NewRegistryClient(host string) *RegistryClient {
+	if host == DockerHubHost || host == "index.docker.io" {
+		host = DockerHubRegistry
+	}
+	return &RegistryClient{
+		Host:       host,
+		PlainHTTP:  isLocalRegistry(host),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func isLocalRegistry(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (c *RegistryClient) baseURL() string {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2", scheme, c.Host)
+}
+
+func (c *RegistryClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *RegistryClient) do(req *http.Request, scope string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		attemptReq := req.Clone(req.Context())
+		c.authorize(attemptReq, scope)
+
+		resp, err := c.httpClient().Do(attemptReq)
+		if err != nil {
+			return nil, fmt.Errorf("request to '%s' failed: %w", req.URL, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			if err := c.handleChallenge(resp, scope); err != nil {
+				return nil, fmt.Errorf("authentication with '%s' failed: %w", c.Host, err)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return nil, fmt.Errorf("unexpected status %s from '%s': %s", resp.Status, req.URL, strings.TrimSpace(string(body)))
+		}
+		return resp, nil
+	}
+}
+
+func (c *RegistryClient) Ping() error {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL()+"/", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create ping request for '%s': %w", c.Host, err)
+	}
+	resp, err := c.do(req, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *RegistryClient) GetManifest(repository, reference string) ([]byte, string, error) {
+	url := fmt.Sprintf("%s/%s/manifests/%s", c.baseURL(), repository, reference)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create manifest request for '%s': %w", url, err)
+	}
+	req.Header.Set("Accept", strings.Join(manifestAcceptTypes, ", "))
+
+	resp, err := c.do(req, repositoryScope(repository))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch manifest '%s:%s': %w", repository, reference, err)
+	}
+	defer resp.Body.Close()
+
+	manifestBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest '%s:%s': %w", repository, reference, err)
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = strings.TrimSpace(mediaType[:i])
+	}
+	return manifestBytes, mediaType, nil
+}
+
+// GetBlobFrom requests a blob starting at offset using an HTTP range request.
+// Registries that do not support ranges send the whole blob; the returned
+// start tells the caller which of the two happened.
+func (c *RegistryClient) GetBlobFrom(repository string, dgst digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	url := fmt.Sprintf("%s/%s/blobs/%s", c.baseURL(), repository, dgst)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create blob request for '%s': %w", url, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.do(req, repositoryScope(repository))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch blob '%s': %w", dgst, err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return resp.Body, 0, nil
+	}
+
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d", &start, &end); err != nil || start != offset {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("registry returned unexpected range '%s' for blob '%s' (requested from %d)", resp.Header.Get("Content-Range"), dgst, offset)
+	}
+	return resp.Body, start, nil
+}
+
+func IsIndexMediaType(mediaType string) bool {
+	return mediaType == specs.MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList
+}
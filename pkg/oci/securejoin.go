@@ -0,0 +1,69 @@
+package oci
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinkFollows = 255
+
+// resolveInRoot resolves unsafePath as if root were the filesystem root:
+// every existing component is looked up with symlinks followed relative to
+// root, and ".." never climbs above it. Components that do not exist yet are
+// kept as they are, so the result is always a path inside root that can be
+// created without traversing any symlink.
+func resolveInRoot(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+	resolved := "/"
+	remaining := filepath.ToSlash(unsafePath)
+	follows := 0
+
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			part, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			part, remaining = remaining, ""
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fullPath := filepath.Join(root, next)
+		info, err := os.Lstat(fullPath)
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to stat '%s': %w", fullPath, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		follows++
+		if follows > maxSymlinkFollows {
+			return "", fmt.Errorf("too many levels of symbolic links resolving '%s'", unsafePath)
+		}
+		link, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read symlink '%s': %w", fullPath, err)
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = link + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
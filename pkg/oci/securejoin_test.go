@@ -0,0 +1,69 @@
+package oci
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"usr/lib", "real"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"abs":       "/usr/lib",
+		"escape":    "../../../..",
+		"hostpath":  root + "/real",
+		"chain1":    "chain2",
+		"chain2":    "usr/../chain3",
+		"chain3":    "/real",
+		"loop1":     "loop2",
+		"loop2":     "loop1",
+		"usr/up":    "../..",
+		"real/self": ".",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "usr/lib/file", want: "usr/lib/file"},
+		{path: "/usr/lib", want: "usr/lib"},
+		{path: "../../etc/passwd", want: "etc/passwd"},
+		{path: "usr/../../real", want: "real"},
+		{path: "abs/file", want: "usr/lib/file"},
+		{path: "escape/etc/passwd", want: "etc/passwd"},
+		{path: "usr/up/etc", want: "etc"},
+		{path: "hostpath/file", want: root[1:] + "/real/file"},
+		{path: "chain1/file", want: "real/file"},
+		{path: "real/self/self/file", want: "real/file"},
+		{path: "missing/../abs", want: "usr/lib"},
+		{path: "loop1/file", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := resolveInRoot(root, tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveInRoot(%q) = %q, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveInRoot(%q): %v", tt.path, err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("resolveInRoot(%q) = %q, want %q", tt.path, got, want)
+			}
+		})
+	}
+}
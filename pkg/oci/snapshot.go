@@ -0,0 +1,120 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+// Snapshotter keeps every layer extracted once into its own directory so
+// containers can stack them as overlay lowerdirs instead of unpacking the
+// whole image per container. Snapshots are keyed by diff_id, since the same
+// uncompressed content may arrive under different compressed digests.
+//
+// Whiteouts are stored in overlayfs format. With userXattr the opaque markers
+// use the user.overlay.* namespace understood by rootless overlay mounts, so
+// such snapshots must live under a different root than trusted.* ones. The
+// same goes for IDMaps, which decides the host owner of every file.
+type Snapshotter struct {
+	Root      string
+	UserXattr bool
+	IDMaps    run.IDMappings
+}
+
+func NewSnapshotter(root string, userXattr bool, idMaps run.IDMappings) (*Snapshotter, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory '%s': %w", root, err)
+	}
+	return &Snapshotter{Root: root, UserXattr: userXattr, IDMaps: idMaps}, nil
+}
+
+func (s *Snapshotter) SnapshotPath(key digest.Digest) string {
+	return filepath.Join(s.Root, key.Algorithm().String(), key.Encoded())
+}
+
+func snapshotKey(layer Layer) digest.Digest {
+	if layer.DiffID != "" {
+		return layer.DiffID
+	}
+	return layer.Digest
+}
+
+func (s *Snapshotter) HasSnapshot(layer Layer) bool {
+	key := snapshotKey(layer)
+	if key == "" {
+		return false
+	}
+	_, err := os.Stat(s.SnapshotPath(key))
+	return err == nil
+}
+
+// Prepare makes sure every layer has an extracted snapshot and returns their
+// directories in layer order (base layer first).
+func (s *Snapshotter) Prepare(layers []Layer) ([]string, error) {
+	dirs := make([]string, len(layers))
+	for i, layer := range layers {
+		key := snapshotKey(layer)
+		if key == "" {
+			return nil, fmt.Errorf("layer '%s' has neither diff_id nor digest", layer.Path)
+		}
+		dirs[i] = s.SnapshotPath(key)
+
+		if s.HasSnapshot(layer) {
+			continue
+		}
+
+		file, err := os.Open(layer.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open layer file '%s': %w", layer.Path, err)
+		}
+		err = s.Extract(layer, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+// Extract creates the snapshot for layer from its compressed blob content.
+// It unpacks into a temporary sibling and renames it into place, so an
+// interrupted extraction never leaves a half-populated snapshot behind.
+func (s *Snapshotter) Extract(layer Layer, r io.Reader) error {
+	key := snapshotKey(layer)
+	if key == "" {
+		return fmt.Errorf("layer '%s' has neither diff_id nor digest", layer.Path)
+	}
+	snapshotPath := s.SnapshotPath(key)
+
+	if err := os.MkdirAll(filepath.Dir(snapshotPath), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot parent for '%s': %w", snapshotPath, err)
+	}
+	tmpPath, err := os.MkdirTemp(filepath.Dir(snapshotPath), ".extract-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary snapshot directory: %w", err)
+	}
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("failed to chmod temporary snapshot directory '%s': %w", tmpPath, err)
+	}
+
+	opts := extractOptions{overlayWhiteouts: true, userXattr: s.UserXattr, idMaps: s.IDMaps}
+	if err := unpackLayerStream(r, layer, tmpPath, opts); err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("failed to extract layer %s: %w", layer.Digest, err)
+	}
+
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		os.RemoveAll(tmpPath)
+		if _, statErr := os.Stat(snapshotPath); statErr == nil {
+			// Another process extracted the same layer concurrently.
+			return nil
+		}
+		return fmt.Errorf("failed to move snapshot into place '%s': %w", snapshotPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/utiles"
+)
+
+// Store is the local image store: a single OCI image layout whose blobs are
+// shared by every image. index.json maps reference names (the
+// org.opencontainers.image.ref.name annotation) to manifest or index digests;
+// entries without that annotation are untagged images kept for containers
+// that were created from them.
+type Store struct {
+	Root string
+}
+
+// ImageRecord is one entry of the store index. Ref is the zero Reference
+// for untagged images.
+type ImageRecord struct {
+	Ref        utiles.Reference
+	Descriptor specs.Descriptor
+}
+
+func (r ImageRecord) Untagged() bool {
+	return r.Ref.Repository == ""
+}
+
+func OpenStore(root string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(root, specs.ImageBlobsDir, "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create image store '%s': %w", root, err)
+	}
+
+	layoutPath := filepath.Join(root, specs.ImageLayoutFile)
+	if _, err := os.Stat(layoutPath); os.IsNotExist(err) {
+		layoutBytes, err := json.Marshal(specs.ImageLayout{Version: specs.ImageLayoutVersion})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal oci-layout: %w", err)
+		}
+		if err := os.WriteFile(layoutPath, layoutBytes, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write '%s': %w", layoutPath, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to stat '%s': %w", layoutPath, err)
+	}
+
+	return &Store{Root: root}, nil
+}
+
+func (s *Store) BlobPath(dgst digest.Digest) string {
+	return filepath.Join(s.Root, specs.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func (s *Store) HasBlob(dgst digest.Digest) bool {
+	_, err := os.Stat(s.BlobPath(dgst))
+	return err == nil
+}
+
+func (s *Store) ReadBlob(dgst digest.Digest) ([]byte, error) {
+	blobBytes, err := os.ReadFile(s.BlobPath(dgst))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", dgst, err)
+	}
+	if err := verifyContent("blob", dgst, blobBytes); err != nil {
+		return nil, err
+	}
+	return blobBytes, nil
+}
+
+// reuseBlob reports whether dgst is already in the store and, if it is,
+// refreshes its mtime: a prune leaves it alone for pruneGracePeriod, giving
+// the caller time to record the image that uses it.
+func (s *Store) reuseBlob(dgst digest.Digest) bool {
+	now := time.Now()
+	return os.Chtimes(s.BlobPath(dgst), now, now) == nil
+}
+
+func (s *Store) WriteBlob(dgst digest.Digest, content []byte) error {
+	if s.reuseBlob(dgst) {
+		return nil
+	}
+	return s.IngestBlob(dgst, int64(len(content)), bytes.NewReader(content))
+}
+
+// IngestBlob copies r into the blob store under dgst, verifying the content
+// against dgst (and size, unless it is negative) on the way. The content is
+// staged in the ingest area first so readers never observe a partial or
+// corrupt blob.
+func (s *Store) IngestBlob(dgst digest.Digest, size int64, r io.Reader) error {
+	fetch := func(int64) (io.ReadCloser, int64, error) {
+		return io.NopCloser(r), 0, nil
+	}
+	return s.IngestBlobResumable(dgst, size, fetch, nil)
+}
+
+func (s *Store) indexPath() string {
+	return filepath.Join(s.Root, specs.ImageIndexFile)
+}
+
+func (s *Store) lock() (func(), error) {
+	lockPath := filepath.Join(s.Root, ".lock")
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store lock '%s': %w", lockPath, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock image store '%s': %w", s.Root, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (s *Store) readIndex() (*OciIndex, error) {
+	index := &OciIndex{SchemaVersion: 2, MediaType: specs.MediaTypeImageIndex}
+	indexBytes, err := os.ReadFile(s.indexPath())
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store index '%s': %w", s.indexPath(), err)
+	}
+	if err := json.Unmarshal(indexBytes, index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal store index '%s': %w", s.indexPath(), err)
+	}
+	return index, nil
+}
+
+func (s *Store) writeIndex(index *OciIndex) error {
+	// An untagged entry is only needed while no tag points at its image.
+	tagged := make(map[digest.Digest]bool)
+	for _, desc := range index.Manifests {
+		if desc.Annotations[specs.AnnotationRefName] != "" {
+			tagged[desc.Digest] = true
+		}
+	}
+	manifests := index.Manifests[:0]
+	for _, desc := range index.Manifests {
+		if desc.Annotations[specs.AnnotationRefName] == "" {
+			if tagged[desc.Digest] {
+				continue
+			}
+			tagged[desc.Digest] = true
+		}
+		manifests = append(manifests, desc)
+	}
+	index.Manifests = manifests
+
+	sort.Slice(index.Manifests, func(i, j int) bool {
+		a, b := index.Manifests[i], index.Manifests[j]
+		if a.Annotations[specs.AnnotationRefName] != b.Annotations[specs.AnnotationRefName] {
+			return a.Annotations[specs.AnnotationRefName] < b.Annotations[specs.AnnotationRefName]
+		}
+		return a.Digest < b.Digest
+	})
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal store index: %w", err)
+	}
+	tmpPath := s.indexPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, indexBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write store index '%s': %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.indexPath()); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace store index '%s': %w", s.indexPath(), err)
+	}
+	return nil
+}
+
+func (s *Store) Images() ([]ImageRecord, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var images []ImageRecord
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[specs.AnnotationRefName]
+		if name == "" {
+			images = append(images, ImageRecord{Descriptor: desc})
+			continue
+		}
+		ref, err := utiles.ParseReference(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping store entry with invalid reference '%s': %v\n", name, err)
+			continue
+		}
+		images = append(images, ImageRecord{Ref: ref, Descriptor: desc})
+	}
+	return images, nil
+}
+
+func (s *Store) Resolve(ref utiles.Reference) (specs.Descriptor, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	name := ref.String()
+	for _, desc := range index.Manifests {
+		if desc.Annotations[specs.AnnotationRefName] == name {
+			return desc, nil
+		}
+	}
+	return specs.Descriptor{}, fmt.Errorf("image '%s' not found in local store", name)
+}
+
+// ResolveManifest is PlatformManifest for the image ref names.
+func (s *Store) ResolveManifest(ref utiles.Reference, platform specs.Platform) (digest.Digest, error) {
+	desc, err := s.Resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	return s.PlatformManifest(desc, platform)
+}
+
+// PlatformManifest follows desc through any image index to the manifest for
+// platform.
+func (s *Store) PlatformManifest(desc specs.Descriptor, platform specs.Platform) (digest.Digest, error) {
+	for IsIndexMediaType(desc.MediaType) {
+		indexBytes, err := s.ReadBlob(desc.Digest)
+		if err != nil {
+			return "", err
+		}
+		var index OciIndex
+		if err := json.Unmarshal(indexBytes, &index); err != nil {
+			return "", fmt.Errorf("failed to unmarshal image index %s: %w", desc.Digest, err)
+		}
+		desc, err = SelectManifest(index, platform)
+		if err != nil {
+			return "", err
+		}
+	}
+	return desc.Digest, nil
+}
+
+// Tag points ref at desc. When ref previously named a different image that
+// no other tag refers to, that image is kept as an untagged entry until it
+// is removed or pruned, since containers may still have been created from
+// it.
+func (s *Store) Tag(ref utiles.Reference, desc specs.Descriptor) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.checkBlobs(desc); err != nil {
+		return err
+	}
+
+	index, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+
+	name := ref.String()
+	desc.Annotations = map[string]string{specs.AnnotationRefName: name}
+	replaced := false
+	for i, existing := range index.Manifests {
+		if existing.Annotations[specs.AnnotationRefName] == name {
+			index.Manifests[i] = desc
+			index.Manifests = append(index.Manifests, untaggedDescriptor(existing))
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	return s.writeIndex(index)
+}
+
+// AddImage records desc as an untagged image, for images that are built
+// without a name.
+func (s *Store) AddImage(desc specs.Descriptor) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.checkBlobs(desc); err != nil {
+		return err
+	}
+
+	index, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+	index.Manifests = append(index.Manifests, untaggedDescriptor(desc))
+	return s.writeIndex(index)
+}
+
+// Untag removes ref from the store and returns the descriptor it pointed
+// at. The image itself stays as an untagged entry when no other tag refers
+// to it.
+func (s *Store) Untag(ref utiles.Reference) (specs.Descriptor, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer unlock()
+
+	index, err := s.readIndex()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	name := ref.String()
+	for i, existing := range index.Manifests {
+		if existing.Annotations[specs.AnnotationRefName] == name {
+			index.Manifests[i] = untaggedDescriptor(existing)
+			return existing, s.writeIndex(index)
+		}
+	}
+	return specs.Descriptor{}, fmt.Errorf("image '%s' not found in local store", name)
+}
+
+// DeleteImage removes every entry, tagged or not, that points at dgst and
+// deletes the blobs no remaining image refers to, leaving those younger than
+// the prune grace period to a later prune. It returns the removed blobs.
+func (s *Store) DeleteImage(dgst digest.Digest) ([]digest.Digest, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var removed *specs.Descriptor
+	kept := index.Manifests[:0]
+	for _, desc := range index.Manifests {
+		if desc.Digest == dgst {
+			d := desc
+			removed = &d
+			continue
+		}
+		kept = append(kept, desc)
+	}
+	if removed == nil {
+		return nil, fmt.Errorf("image %s not found in local store", dgst)
+	}
+	index.Manifests = kept
+	if err := s.writeIndex(index); err != nil {
+		return nil, err
+	}
+	return s.releaseBlobs(index, s.reachableBlobs(*removed))
+}
+
+// TagsOf returns the references currently pointing at dgst.
+func (s *Store) TagsOf(dgst digest.Digest) ([]utiles.Reference, error) {
+	images, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	var refs []utiles.Reference
+	for _, img := range images {
+		if img.Descriptor.Digest == dgst && !img.Untagged() {
+			refs = append(refs, img.Ref)
+		}
+	}
+	return refs, nil
+}
+
+// ResolveID finds the image whose digest is id, or starts with it, the way
+// `list --images` abbreviates them. An optional "sha256:" prefix is accepted.
+func (s *Store) ResolveID(id string) (specs.Descriptor, error) {
+	id = strings.TrimPrefix(id, digest.SHA256.String()+":")
+	if id == "" || strings.Trim(id, "0123456789abcdef") != "" {
+		return specs.Descriptor{}, fmt.Errorf("'%s' is not an image ID", id)
+	}
+	index, err := s.readIndex()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	var found *specs.Descriptor
+	for _, desc := range index.Manifests {
+		if !strings.HasPrefix(desc.Digest.Encoded(), id) {
+			continue
+		}
+		if found != nil && found.Digest != desc.Digest {
+			return specs.Descriptor{}, fmt.Errorf("image ID '%s' is ambiguous", id)
+		}
+		d := desc
+		found = &d
+	}
+	if found == nil {
+		return specs.Descriptor{}, fmt.Errorf("image ID '%s' not found in local store", id)
+	}
+	return *found, nil
+}
+
+// checkBlobs makes sure the manifest desc names and its config and layers
+// are all present. Tag and AddImage call it with the store locked, so a prune
+// cannot remove one of them before the image is in the index.
+func (s *Store) checkBlobs(desc specs.Descriptor) error {
+	content, err := s.ReadBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if desc.MediaType != specs.MediaTypeImageManifest && desc.MediaType != MediaTypeDockerManifest {
+		return nil
+	}
+	var manifest OciManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return fmt.Errorf("failed to unmarshal manifest %s: %w", desc.Digest, err)
+	}
+	for _, blob := range append([]specs.Descriptor{manifest.Config}, manifest.Layers...) {
+		if !s.HasBlob(blob.Digest) {
+			return fmt.Errorf("blob %s of image %s is missing from the image store", blob.Digest, desc.Digest)
+		}
+	}
+	return nil
+}
+
+func untaggedDescriptor(desc specs.Descriptor) specs.Descriptor {
+	return specs.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}
+}
+
+// reachableBlobs lists every locally present blob an image descriptor
+// refers to: the descriptor itself, nested manifests, configs and layers.
+func (s *Store) reachableBlobs(desc specs.Descriptor) []digest.Digest {
+	seen := make(map[digest.Digest]bool)
+	var walk func(d specs.Descriptor)
+	walk = func(d specs.Descriptor) {
+		if seen[d.Digest] || !s.HasBlob(d.Digest) {
+			return
+		}
+		seen[d.Digest] = true
+
+		content, err := s.ReadBlob(d.Digest)
+		if err != nil {
+			return
+		}
+		switch {
+		case IsIndexMediaType(d.MediaType):
+			var index OciIndex
+			if json.Unmarshal(content, &index) == nil {
+				for _, m := range index.Manifests {
+					walk(m)
+				}
+			}
+		case d.MediaType == specs.MediaTypeImageManifest || d.MediaType == MediaTypeDockerManifest:
+			var manifest OciManifest
+			if json.Unmarshal(content, &manifest) == nil {
+				if s.HasBlob(manifest.Config.Digest) {
+					seen[manifest.Config.Digest] = true
+				}
+				for _, layer := range manifest.Layers {
+					if s.HasBlob(layer.Digest) {
+						seen[layer.Digest] = true
+					}
+				}
+			}
+		}
+	}
+	walk(desc)
+
+	blobs := make([]digest.Digest, 0, len(seen))
+	for dgst := range seen {
+		blobs = append(blobs, dgst)
+	}
+	return blobs
+}
+
+// BlobRefCounts returns, for every blob reachable from an image in the index,
+// tagged or not, the number of those images that reference it.
+func (s *Store) BlobRefCounts() (map[digest.Digest]int, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return s.refCounts(index), nil
+}
+
+func (s *Store) refCounts(index *OciIndex) map[digest.Digest]int {
+	counts := make(map[digest.Digest]int)
+	for _, desc := range index.Manifests {
+		for _, dgst := range s.reachableBlobs(desc) {
+			counts[dgst]++
+		}
+	}
+	return counts
+}
+
+func (s *Store) releaseBlobs(index *OciIndex, candidates []digest.Digest) ([]digest.Digest, error) {
+	counts := s.refCounts(index)
+	var removed []digest.Digest
+	for _, dgst := range candidates {
+		if counts[dgst] > 0 {
+			continue
+		}
+		// A concurrent pull, load or build may be about to record an image
+		// using this blob: it wrote or reused the blob within the grace
+		// period, and Tag rejects the image if the blob is gone by then.
+		info, err := os.Stat(s.BlobPath(dgst))
+		if err != nil || time.Since(info.ModTime()) < pruneGracePeriod {
+			continue
+		}
+		if err := os.Remove(s.BlobPath(dgst)); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove unreferenced blob %s: %w", dgst, err)
+		}
+		removed = append(removed, dgst)
+	}
+	return removed, nil
+}
@@ -2,24 +2,42 @@ package oci
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+	"golang.org/x/sys/unix"
 )
 
-func UnpackImageLayers(layerTarPaths []string, rootfsPath string) error {
+type Layer struct {
+	Path      string
+	MediaType string
+	Digest    digest.Digest
+	Size      int64
+	DiffID    digest.Digest
+}
+
+func UnpackImageLayers(layers []Layer, rootfsPath string, idMaps run.IDMappings) error {
 
 	if err := os.MkdirAll(rootfsPath, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", rootfsPath, err)
 	}
 
-	for _, LayerPath := range layerTarPaths {
+	for _, layer := range layers {
 
-		if err := unpackLayer(LayerPath, rootfsPath); err != nil {
-			return fmt.Errorf("failed to unpack layer %s: %w", LayerPath, err)
+		if err := unpackLayer(layer, rootfsPath, extractOptions{idMaps: idMaps}); err != nil {
+			return fmt.Errorf("failed to unpack layer %s: %w", layer.Path, err)
 		}
 	}
 
@@ -27,20 +45,166 @@ func UnpackImageLayers(layerTarPaths []string, rootfsPath string) error {
 
 }
 
-func unpackLayer(tarGzPath, destPath string) error {
-	file, err := os.Open(tarGzPath)
+type compression int
+
+const (
+	compressionNone compression = iota
+	compressionGzip
+	compressionZstd
+)
+
+func (c compression) String() string {
+	switch c {
+	case compressionGzip:
+		return "gzip"
+	case compressionZstd:
+		return "zstd"
+	}
+	return "uncompressed"
+}
+
+func compressionFromMediaType(mediaType string) (compression, bool) {
+	switch mediaType {
+	case specs.MediaTypeImageLayerGzip, specs.MediaTypeImageLayerNonDistributableGzip, MediaTypeDockerLayerGzip, MediaTypeDockerForeignLayerGzip:
+		return compressionGzip, true
+	case specs.MediaTypeImageLayerZstd, specs.MediaTypeImageLayerNonDistributableZstd:
+		return compressionZstd, true
+	case specs.MediaTypeImageLayer, specs.MediaTypeImageLayerNonDistributable, MediaTypeDockerLayer:
+		return compressionNone, true
+	}
+	return compressionNone, false
+}
+
+func detectCompression(magic []byte) compression {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return compressionGzip
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+// decompressLayer returns the tar stream of a layer blob. The media type
+// decides the codec; the stream's magic bytes are only used for media types
+// that do not name one, and for `docker save` archives, which label plain tar
+// layers as gzip. Any other disagreement is an error.
+func decompressLayer(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read layer header: %w", err)
+	}
+
+	sniffed := detectCompression(magic)
+	codec, known := compressionFromMediaType(mediaType)
+	switch {
+	case !known:
+		codec = sniffed
+	case codec == compressionGzip && sniffed == compressionNone:
+		codec = compressionNone
+	case codec != sniffed:
+		return nil, fmt.Errorf("layer media type '%s' says %s but content is %s", mediaType, codec, sniffed)
+	}
+
+	switch codec {
+	case compressionGzip:
+		gzReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gzReader, nil
+	case compressionZstd:
+		zstdReader, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zstdReader.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+func unpackLayer(layer Layer, destPath string, opts extractOptions) error {
+	file, err := os.Open(layer.Path)
 	if err != nil {
-		return fmt.Errorf("failed to open layer file '%s': %w", tarGzPath, err)
+		return fmt.Errorf("failed to open layer file '%s': %w", layer.Path, err)
 	}
 	defer file.Close()
 
-	gzReader, err := gzip.NewReader(file)
+	return unpackLayerStream(file, layer, destPath, opts)
+}
+
+// unpackLayerStream extracts a compressed layer blob read from r, which lets
+// a layer be unpacked while it is still being downloaded.
+func unpackLayerStream(r io.Reader, layer Layer, destPath string, opts extractOptions) error {
+	// Both the compressed blob and the uncompressed tar stream are hashed
+	// while extracting, so a tampered layer is caught without a second read.
+	var err error
+	var blobReader io.Reader = r
+	var blobVerifier *verifyingReader
+	if layer.Digest != "" {
+		size := layer.Size
+		if size == 0 {
+			size = -1
+		}
+		if blobVerifier, err = newVerifyingReader(r, "layer", layer.Digest, size); err != nil {
+			return err
+		}
+		blobReader = blobVerifier
+	}
+
+	stream, err := decompressLayer(blobReader, layer.MediaType)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader for '%s': %w", tarGzPath, err)
+		return fmt.Errorf("failed to decompress layer %s: %w", layer.Digest, err)
 	}
-	defer gzReader.Close()
+	defer stream.Close()
 
-	tarReader := tar.NewReader(gzReader)
+	var tarStream io.Reader = stream
+	var diffVerifier *verifyingReader
+	if layer.DiffID != "" {
+		if diffVerifier, err = newVerifyingReader(stream, "uncompressed layer", layer.DiffID, -1); err != nil {
+			return err
+		}
+		tarStream = diffVerifier
+	}
+
+	if err := extractTar(tarStream, destPath, opts); err != nil {
+		return err
+	}
+
+	// tar.Reader stops at the end-of-archive marker; drain the padding so the
+	// hashes cover the complete streams.
+	if _, err := io.Copy(io.Discard, tarStream); err != nil {
+		return fmt.Errorf("failed to read trailing data of layer %s: %w", layer.Digest, err)
+	}
+	if _, err := io.Copy(io.Discard, blobReader); err != nil {
+		return fmt.Errorf("failed to read trailing data of layer %s: %w", layer.Digest, err)
+	}
+	if blobVerifier != nil {
+		if err := blobVerifier.check(); err != nil {
+			return err
+		}
+	}
+	if diffVerifier != nil {
+		if err := diffVerifier.check(); err != nil {
+			return fmt.Errorf("layer %s does not match config diff_id: %w", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+// extractTar writes a layer's entries below destPath. Every entry's parent
+// directory is resolved inside destPath, following symlinks the image has
+// already created as the container would see them, so a layer cannot use a
+// symlink or hard link to reach files outside the rootfs.
+func extractTar(r io.Reader, destPath string, opts extractOptions) error {
+	tarReader := tar.NewReader(r)
+	writes := newLayerWrites()
+	destPath = filepath.Clean(destPath)
+	// Directories get their metadata once the whole layer is written, so
+	// that entries extracted into them neither change their mtime nor fail
+	// on a read-only mode.
+	var dirs []extractedDir
 
 	for {
 		header, err := tarReader.Next()
@@ -51,36 +215,51 @@ func unpackLayer(tarGzPath, destPath string) error {
 			return fmt.Errorf("failed to read tar header: %w", err)
 		}
 
-		target := filepath.Join(destPath, header.Name)
-		if !strings.HasPrefix(target, filepath.Clean(destPath)+string(os.PathSeparator)) {
+		joined := filepath.Join(destPath, header.Name)
+		if joined == destPath {
+			// The layer's own root entry ("./"); the rootfs already exists.
+			continue
+		}
+		if !strings.HasPrefix(joined, destPath+string(os.PathSeparator)) {
 			return fmt.Errorf("invalid tar header name (path traversal): %s", header.Name)
 		}
+		name := strings.TrimPrefix(joined, destPath)
+
+		parent, err := resolveInRoot(destPath, filepath.Dir(name))
+		if err != nil {
+			return fmt.Errorf("failed to resolve parent of '%s': %w", header.Name, err)
+		}
+		target := filepath.Join(parent, filepath.Base(name))
+		if target == destPath {
+			// A symlink resolved the parent to "/" and the name was "..".
+			return fmt.Errorf("invalid tar header name (resolves to rootfs): %s", header.Name)
+		}
 
-		baseName := filepath.Base(header.Name)
-		if strings.HasPrefix(baseName, ".wh.") {
-			originalName := strings.TrimPrefix(baseName, ".wh.")
-			pathToDelete := filepath.Join(filepath.Dir(target), originalName)
-			if err := os.RemoveAll(pathToDelete); err != nil {
-				fmt.Fprintf(os.Stderr, "warning: failed to remove whiteout path '%s': %v\n", pathToDelete, err)
+		if strings.HasPrefix(filepath.Base(target), whiteoutPrefix) {
+			if err := applyWhiteout(destPath, target, opts, writes); err != nil {
+				return err
 			}
 			continue
 		}
+		writes.add(destPath, target)
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to create parent directory for '%s': %w", target, err)
+		}
+		if err := replaceExisting(target, header.Typeflag == tar.TypeDir); err != nil {
+			return err
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+			if err := os.MkdirAll(target, 0755); err != nil {
 				return fmt.Errorf("failed to create directory '%s': %w", target, err)
 			}
-			if err := os.Chmod(target, os.FileMode(header.Mode)); err != nil {
-				fmt.Fprintf(os.Stderr, "warning: failed to chmod directory '%s': %v\n", target, err)
-			}
+			dirs = append(dirs, extractedDir{target: target, header: header})
+			continue
 
 		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return fmt.Errorf("failed to create parent directory for file '%s': %w", target, err)
-			}
-
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, os.FileMode(header.Mode))
 			if err != nil {
 				return fmt.Errorf("failed to create file '%s': %w", target, err)
 			}
@@ -91,39 +270,207 @@ func unpackLayer(tarGzPath, destPath string) error {
 			}
 			outFile.Close()
 
-			if err := os.Chmod(target, os.FileMode(header.Mode)); err != nil {
-				fmt.Fprintf(os.Stderr, "warning: failed to chmod file '%s': %v\n", target, err)
-			}
-
 		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return fmt.Errorf("failed to create parent directory for symlink '%s': %w", target, err)
-			}
-			if _, err := os.Lstat(target); err == nil {
-				os.Remove(target)
-			}
 			if err := os.Symlink(header.Linkname, target); err != nil {
 				return fmt.Errorf("failed to create symlink '%s' -> '%s': %w", target, header.Linkname, err)
 			}
 
 		case tar.TypeLink:
-			linkTarget := filepath.Join(destPath, header.Linkname)
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return fmt.Errorf("failed to create parent directory for hardlink '%s': %w", target, err)
-			}
-			if _, err := os.Lstat(target); err == nil {
-				os.Remove(target)
+			linkTarget, err := resolveLinkTarget(destPath, header.Linkname)
+			if err != nil {
+				return fmt.Errorf("invalid hard link '%s': %w", header.Name, err)
 			}
 			if err := os.Link(linkTarget, target); err != nil {
 				return fmt.Errorf("failed to create hard link '%s' -> '%s': %w", target, linkTarget, err)
 			}
+			// A hard link shares the inode, and so the metadata, of its target.
+			continue
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := createSpecialFile(target, header); err != nil {
+				return err
+			}
 
 		default:
 			fmt.Fprintf(os.Stderr, "warning: unsupported file type '%c' for '%s'\n", header.Typeflag, header.Name)
+			continue
 		}
 
-		os.Chtimes(target, header.AccessTime, header.ModTime)
+		applyMetadata(target, header, opts)
+	}
+
+	// Deepest first, so setting a directory's times is not undone by
+	// changing one of its subdirectories.
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].target, "/") > strings.Count(dirs[j].target, "/")
+	})
+	for _, dir := range dirs {
+		if info, err := os.Lstat(dir.target); err != nil || !info.IsDir() {
+			// Removed or replaced by a later entry.
+			continue
+		}
+		applyMetadata(dir.target, dir.header, opts)
 	}
+	return nil
+}
+
+type extractedDir struct {
+	target string
+	header *tar.Header
+}
 
+// replaceExisting clears whatever a lower layer (or an earlier entry) left at
+// target, so the new entry is never written through an old symlink. Only a
+// directory replacing a directory is merged.
+func replaceExisting(target string, isDir bool) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat '%s': %w", target, err)
+	}
+	if isDir && info.IsDir() {
+		return nil
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("failed to replace '%s': %w", target, err)
+	}
 	return nil
 }
+
+// resolveLinkTarget maps a hard link's target name to the file inside
+// destPath it refers to. The final component is not followed, matching
+// link(2), which links a symlink itself rather than what it points to.
+func resolveLinkTarget(destPath, linkname string) (string, error) {
+	name := filepath.Clean("/" + linkname)
+	if name == "/" {
+		return "", fmt.Errorf("link target '%s' is the rootfs", linkname)
+	}
+	parent, err := resolveInRoot(destPath, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	linkTarget := filepath.Join(parent, filepath.Base(name))
+	info, err := os.Lstat(linkTarget)
+	if err != nil {
+		return "", fmt.Errorf("link target '%s' does not exist in the layer: %w", linkname, err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("link target '%s' is a directory", linkname)
+	}
+	return linkTarget, nil
+}
+
+func createSpecialFile(target string, header *tar.Header) error {
+	mode := uint32(header.Mode) & 07777
+	switch header.Typeflag {
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(target, mode); err != nil {
+			return fmt.Errorf("failed to create fifo '%s': %w", target, err)
+		}
+		return nil
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	}
+
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	err := unix.Mknod(target, mode, int(dev))
+	if err == nil {
+		return nil
+	}
+	if err != unix.EPERM {
+		return fmt.Errorf("failed to create device node '%s': %w", target, err)
+	}
+
+	// Without CAP_MKNOD (rootless) device nodes cannot be created. Leave an
+	// empty file in their place so paths like /dev/null still exist; the
+	// runtime bind mounts real devices over them where it needs them.
+	fmt.Fprintf(os.Stderr, "warning: cannot create device '%s' (%d:%d) without privileges, creating an empty file instead\n", header.Name, header.Devmajor, header.Devminor)
+	placeholder, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create placeholder for device '%s': %w", target, err)
+	}
+	return placeholder.Close()
+}
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// applyMetadata sets ownership, permissions, xattrs and timestamps on an
+// extracted entry. The order matters: chown clears setuid bits and file
+// capabilities, so mode and xattrs are applied after it. Failures are only
+// warnings since rootless extraction cannot honour all of them.
+func applyMetadata(target string, header *tar.Header, opts extractOptions) {
+	uid, uidOK := opts.idMaps.HostUID(header.Uid)
+	gid, gidOK := opts.idMaps.HostGID(header.Gid)
+	if uidOK && gidOK {
+		if err := os.Lchown(target, uid, gid); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to chown '%s' to %d:%d: %v\n", target, uid, gid, err)
+		}
+	}
+	// IDs outside the mapping cannot be represented in the container's user
+	// namespace; such entries stay owned by the extracting user.
+
+	if header.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, fileModeFromHeader(header)); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to chmod '%s': %v\n", target, err)
+		}
+	}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to set xattr '%s' on '%s': %v\n", name, target, err)
+		}
+	}
+
+	times := []unix.Timespec{unix.NsecToTimespec(header.AccessTime.UnixNano()), unix.NsecToTimespec(header.ModTime.UnixNano())}
+	if header.AccessTime.IsZero() {
+		times[0] = times[1]
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to set times on '%s': %v\n", target, err)
+	}
+}
+
+func fileModeFromHeader(header *tar.Header) os.FileMode {
+	mode := os.FileMode(header.Mode).Perm()
+	if header.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if header.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if header.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// IsArchive reports whether the file at path is a tarball, optionally gzip or
+// zstd compressed.
+func IsArchive(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stream, err := decompressLayer(f, "")
+	if err != nil {
+		return false
+	}
+	defer stream.Close()
+	_, err = tar.NewReader(stream).Next()
+	return err == nil
+}
+
+// ExtractArchive unpacks the tarball at path below destPath with the same
+// protections as image layers.
+func ExtractArchive(path, destPath string, idMaps run.IDMappings) error {
+	return unpackLayer(Layer{Path: path}, destPath, extractOptions{idMaps: idMaps})
+}
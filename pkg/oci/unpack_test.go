@@ -0,0 +1,324 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+	mode     int64
+	modTime  time.Time
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.content)), ModTime: e.modTime}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if e.mode != 0 {
+			header.Mode = e.mode
+		}
+		if e.typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// snapshotTree returns every path below dir with the content of regular
+// files and the target of symlinks.
+func snapshotTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "-> " + target
+		case d.Type().IsRegular():
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tree[rel] = string(content)
+		default:
+			tree[rel] = "dir"
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// TestExtractTarHostileLayers extracts layers that try to write outside the
+// rootfs. The rootfs and a "host" directory standing in for the rest of the
+// filesystem share a temporary directory; nothing but the rootfs may change
+// whatever the layer does.
+func TestExtractTarHostileLayers(t *testing.T) {
+	tests := []struct {
+		name string
+		// entries may use HOST for the absolute path of the host directory.
+		entries []tarEntry
+		wantErr string
+		// want lists paths expected inside the rootfs (HOST as above) with
+		// their content, "dir", or "-> target" for symlinks.
+		want map[string]string
+	}{
+		{
+			name: "absolute symlink escape",
+			entries: []tarEntry{
+				{name: "etc", typeflag: tar.TypeSymlink, linkname: "HOST/etc"},
+				{name: "etc/passwd", typeflag: tar.TypeReg, content: "pwned"},
+			},
+			want: map[string]string{"etc": "-> HOST/etc", "HOST/etc/passwd": "pwned"},
+		},
+		{
+			name: "absolute symlink to a host path",
+			entries: []tarEntry{
+				{name: "etc", typeflag: tar.TypeSymlink, linkname: "/host/etc"},
+				{name: "etc/passwd", typeflag: tar.TypeReg, content: "pwned"},
+			},
+			want: map[string]string{"etc": "-> /host/etc", "host/etc/passwd": "pwned"},
+		},
+		{
+			name: "relative symlink escape",
+			entries: []tarEntry{
+				{name: "x", typeflag: tar.TypeSymlink, linkname: "../../.."},
+				{name: "x/f", typeflag: tar.TypeReg, content: "pwned"},
+			},
+			want: map[string]string{"x": "-> ../../..", "f": "pwned"},
+		},
+		{
+			name: "relative symlink to a sibling of the rootfs",
+			entries: []tarEntry{
+				{name: "x", typeflag: tar.TypeSymlink, linkname: "../../../host"},
+				{name: "x/f", typeflag: tar.TypeReg, content: "pwned"},
+			},
+			want: map[string]string{"x": "-> ../../../host", "host/f": "pwned"},
+		},
+		{
+			name: "hard link to a file outside the rootfs",
+			entries: []tarEntry{
+				{name: "secret", typeflag: tar.TypeLink, linkname: "../host/secret"},
+			},
+			wantErr: "invalid hard link",
+		},
+		{
+			name: "hard link to an absolute host path",
+			entries: []tarEntry{
+				{name: "secret", typeflag: tar.TypeLink, linkname: "HOST/secret"},
+			},
+			wantErr: "invalid hard link",
+		},
+		{
+			name: "hard link through a symlink",
+			entries: []tarEntry{
+				{name: "h", typeflag: tar.TypeSymlink, linkname: "HOST"},
+				{name: "secret", typeflag: tar.TypeLink, linkname: "h/secret"},
+			},
+			wantErr: "invalid hard link",
+		},
+		{
+			name: "hard link inside the rootfs",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeReg, content: "data"},
+				{name: "b", typeflag: tar.TypeLink, linkname: "a"},
+			},
+			want: map[string]string{"a": "data", "b": "data"},
+		},
+		{
+			name:    "dot-dot in the entry name",
+			entries: []tarEntry{{name: "../escape", typeflag: tar.TypeReg, content: "pwned"}},
+			wantErr: "path traversal",
+		},
+		{
+			name:    "dot-dot after a directory",
+			entries: []tarEntry{{name: "a/../../escape", typeflag: tar.TypeReg, content: "pwned"}},
+			wantErr: "path traversal",
+		},
+		{
+			name: "symlink chain",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "b"},
+				{name: "b", typeflag: tar.TypeSymlink, linkname: "c/.."},
+				{name: "c", typeflag: tar.TypeSymlink, linkname: "HOST/etc"},
+				{name: "a/f", typeflag: tar.TypeReg, content: "pwned"},
+			},
+			want: map[string]string{"HOST/f": "pwned"},
+		},
+		{
+			name: "symlink loop",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "b"},
+				{name: "b", typeflag: tar.TypeSymlink, linkname: "a"},
+				{name: "a/f", typeflag: tar.TypeReg, content: "pwned"},
+			},
+			wantErr: "too many levels of symbolic links",
+		},
+		{
+			name: "symlink replaced by a directory",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeSymlink, linkname: "HOST"},
+				{name: "d", typeflag: tar.TypeDir},
+				{name: "d/f", typeflag: tar.TypeReg, content: "inside"},
+			},
+			want: map[string]string{"d": "dir", "d/f": "inside"},
+		},
+		{
+			name: "symlink replaced by a file",
+			entries: []tarEntry{
+				{name: "secret", typeflag: tar.TypeSymlink, linkname: "HOST/secret"},
+				{name: "secret", typeflag: tar.TypeReg, content: "inside"},
+			},
+			want: map[string]string{"secret": "inside"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			// Nested so that "../../.." from the rootfs lands in base.
+			root := filepath.Join(base, "containers", "c1", "rootfs")
+			host := filepath.Join(base, "host")
+			for _, dir := range []string{root, filepath.Join(host, "etc")} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, content := range map[string]string{"etc/passwd": "root:x:0:0::/root:/bin/sh\n", "secret": "host secret\n"} {
+				if err := os.WriteFile(filepath.Join(host, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hostBefore := snapshotTree(t, host)
+
+			entries := make([]tarEntry, len(tt.entries))
+			for i, e := range tt.entries {
+				e.linkname = strings.ReplaceAll(e.linkname, "HOST", host)
+				entries[i] = e
+			}
+			opts := extractOptions{idMaps: run.ContainerIDMappings(os.Getuid(), os.Getgid())}
+			err := extractTar(buildTar(t, entries), root, opts)
+
+			if hostAfter := snapshotTree(t, host); !equalTrees(hostBefore, hostAfter) {
+				t.Errorf("host directory changed: before %v, after %v", hostBefore, hostAfter)
+			}
+			siblings, _ := os.ReadDir(base)
+			for _, sibling := range siblings {
+				if name := sibling.Name(); name != "containers" && name != "host" {
+					t.Errorf("extraction created '%s' next to the rootfs", name)
+				}
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractTar error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractTar: %v", err)
+			}
+			got := snapshotTree(t, root)
+			for name, want := range tt.want {
+				name = strings.ReplaceAll(name, "HOST", strings.TrimPrefix(host, "/"))
+				want = strings.ReplaceAll(want, "HOST", host)
+				if got[name] != want {
+					t.Errorf("rootfs '%s' = %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+// TestExtractTarDirectoryMetadata checks that a directory keeps the mode and
+// mtime of its header although entries are extracted into it afterwards.
+func TestExtractTarDirectoryMetadata(t *testing.T) {
+	root := t.TempDir()
+	t.Cleanup(func() { os.Chmod(filepath.Join(root, "ro"), 0755) })
+	roTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	subTime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	entries := []tarEntry{
+		{name: "ro/", typeflag: tar.TypeDir, mode: 0555, modTime: roTime},
+		{name: "ro/sub/", typeflag: tar.TypeDir, mode: 0700, modTime: subTime},
+		{name: "ro/sub/f", typeflag: tar.TypeReg, content: "f"},
+		{name: "ro/g", typeflag: tar.TypeReg, content: "g"},
+	}
+	opts := extractOptions{idMaps: run.ContainerIDMappings(os.Getuid(), os.Getgid())}
+	if err := extractTar(buildTar(t, entries), root, opts); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		mode    os.FileMode
+		modTime time.Time
+	}{
+		{"ro", 0555, roTime},
+		{"ro/sub", 0700, subTime},
+	} {
+		info, err := os.Stat(filepath.Join(root, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != tt.mode {
+			t.Errorf("'%s' mode = %v, want %v", tt.name, info.Mode().Perm(), tt.mode)
+		}
+		if !info.ModTime().Equal(tt.modTime) {
+			t.Errorf("'%s' mtime = %v, want %v", tt.name, info.ModTime(), tt.modTime)
+		}
+	}
+	for _, name := range []string{"ro/sub/f", "ro/g"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("'%s' was not extracted: %v", name, err)
+		}
+	}
+}
+
+func equalTrees(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type IntegrityError struct {
+	Kind     string
+	Blob     digest.Digest
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for %s %s: expected %s, got %s", e.Kind, e.Blob, e.Expected, e.Actual)
+}
+
+func verifyContent(kind string, expected digest.Digest, content []byte) error {
+	if err := expected.Validate(); err != nil {
+		return fmt.Errorf("invalid %s digest '%s': %w", kind, expected, err)
+	}
+	if actual := expected.Algorithm().FromBytes(content); actual != expected {
+		return &IntegrityError{Kind: kind, Blob: expected, Expected: expected.String(), Actual: actual.String()}
+	}
+	return nil
+}
+
+// verifyingReader hashes everything read through it; check compares the
+// result once the stream has been consumed to EOF.
+type verifyingReader struct {
+	r        io.Reader
+	kind     string
+	expected digest.Digest
+	size     int64
+	digester digest.Digester
+	read     int64
+}
+
+func newVerifyingReader(r io.Reader, kind string, expected digest.Digest, size int64) (*verifyingReader, error) {
+	if err := expected.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s digest '%s': %w", kind, expected, err)
+	}
+	return &verifyingReader{
+		r:        r,
+		kind:     kind,
+		expected: expected,
+		size:     size,
+		digester: expected.Algorithm().Digester(),
+	}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.digester.Hash().Write(p[:n])
+	v.read += int64(n)
+	return n, err
+}
+
+func (v *verifyingReader) check() error {
+	if v.size >= 0 && v.read != v.size {
+		return &IntegrityError{Kind: v.kind, Blob: v.expected, Expected: fmt.Sprintf("%d bytes", v.size), Actual: fmt.Sprintf("%d bytes", v.read)}
+	}
+	if actual := v.digester.Digest(); actual != v.expected {
+		return &IntegrityError{Kind: v.kind, Blob: v.expected, Expected: v.expected.String(), Actual: actual.String()}
+	}
+	return nil
+}
+
+func (s *Store) VerifyBlob(kind string, dgst digest.Digest) error {
+	f, err := os.Open(s.BlobPath(dgst))
+	if err != nil {
+		return fmt.Errorf("failed to open %s blob %s: %w", kind, dgst, err)
+	}
+	defer f.Close()
+
+	verifier, err := newVerifyingReader(f, kind, dgst, -1)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, verifier); err != nil {
+		return fmt.Errorf("failed to read %s blob %s: %w", kind, dgst, err)
+	}
+	return verifier.check()
+}
+
+// VerifyImage re-hashes every locally present blob reachable from desc,
+// including the uncompressed content of each layer against the config's
+// rootfs.diff_ids. Progress is written to out; the first failure is returned
+// after all blobs have been checked.
+func VerifyImage(store *Store, desc specs.Descriptor, out io.Writer) error {
+	var firstErr error
+	report := func(kind string, dgst digest.Digest, err error) {
+		if err != nil {
+			fmt.Fprintf(out, "FAIL  %-8s %s: %v\n", kind, dgst, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		fmt.Fprintf(out, "OK    %-8s %s\n", kind, dgst)
+	}
+
+	var verifyDesc func(d specs.Descriptor)
+	verifyDesc = func(d specs.Descriptor) {
+		if IsIndexMediaType(d.MediaType) {
+			content, err := store.ReadBlob(d.Digest)
+			report("index", d.Digest, err)
+			if err != nil {
+				return
+			}
+			var index OciIndex
+			if err := json.Unmarshal(content, &index); err != nil {
+				report("index", d.Digest, fmt.Errorf("failed to unmarshal index: %w", err))
+				return
+			}
+			for _, m := range index.Manifests {
+				if store.HasBlob(m.Digest) {
+					verifyDesc(m)
+				}
+			}
+			return
+		}
+
+		manifest, err := ReadManifest(store.Root, d.Digest.String())
+		report("manifest", d.Digest, err)
+		if err != nil {
+			return
+		}
+		config, err := ReadConfig(store.Root, manifest.Config.Digest.String())
+		report("config", manifest.Config.Digest, err)
+		if err != nil {
+			return
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+			report("config", manifest.Config.Digest, fmt.Errorf("config lists %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers)))
+			return
+		}
+		for i, layer := range manifest.Layers {
+			err := store.VerifyBlob("layer", layer.Digest)
+			if err == nil {
+				err = verifyLayerDiffID(store.BlobPath(layer.Digest), layer, digest.Digest(config.RootFS.DiffIDs[i]))
+			}
+			report("layer", layer.Digest, err)
+		}
+	}
+	verifyDesc(desc)
+
+	return firstErr
+}
+
+func verifyLayerDiffID(path string, layer specs.Descriptor, diffID digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open layer '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	stream, err := decompressLayer(f, layer.MediaType)
+	if err != nil {
+		return fmt.Errorf("failed to decompress layer %s: %w", layer.Digest, err)
+	}
+	defer stream.Close()
+
+	verifier, err := newVerifyingReader(stream, "uncompressed layer", diffID, -1)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, verifier); err != nil {
+		return fmt.Errorf("failed to read layer %s: %w", layer.Digest, err)
+	}
+	if err := verifier.check(); err != nil {
+		return fmt.Errorf("layer %s does not match config diff_id: %w", layer.Digest, err)
+	}
+	return nil
+}
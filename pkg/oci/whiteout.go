@@ -0,0 +1,129 @@
+package oci
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/souhailBektachi/container_runtime_with_go/pkg/run"
+)
+
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+	whiteoutOpaqueDir  = whiteoutMetaPrefix + ".opq"
+)
+
+// extractOptions controls how layer whiteouts are materialised. By default
+// they are applied to destPath directly (copy mode, where every layer is
+// unpacked into the same tree). With overlayWhiteouts they are translated to
+// the overlayfs on-disk format instead, because each layer lives in its own
+// snapshot directory and lower contents are hidden at mount time. idMaps
+// translates the image's file owners to host IDs.
+type extractOptions struct {
+	overlayWhiteouts bool
+	userXattr        bool
+	idMaps           run.IDMappings
+}
+
+func (o extractOptions) opaqueXattr() string {
+	if o.userXattr {
+		return "user.overlay.opaque"
+	}
+	return "trusted.overlay.opaque"
+}
+
+// layerWrites records which paths the layer being extracted has created, so
+// whiteouts only ever hide content from lower layers, as the image spec
+// requires.
+type layerWrites struct {
+	written map[string]bool
+	touched map[string]bool
+}
+
+func newLayerWrites() *layerWrites {
+	return &layerWrites{written: make(map[string]bool), touched: make(map[string]bool)}
+}
+
+func (w *layerWrites) add(destPath, target string) {
+	w.written[target] = true
+	root := filepath.Clean(destPath)
+	for p := target; p != root && p != "/" && p != "."; p = filepath.Dir(p) {
+		w.touched[p] = true
+	}
+}
+
+func applyWhiteout(destPath, target string, opts extractOptions, writes *layerWrites) error {
+	baseName := filepath.Base(target)
+	dir := filepath.Dir(target)
+
+	if baseName == whiteoutOpaqueDir {
+		if opts.overlayWhiteouts {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create opaque directory '%s': %w", dir, err)
+			}
+			if err := syscall.Setxattr(dir, opts.opaqueXattr(), []byte("y"), 0); err != nil {
+				return fmt.Errorf("failed to mark directory '%s' opaque: %w", dir, err)
+			}
+			return nil
+		}
+		return clearOpaqueDir(dir, writes)
+	}
+	if strings.HasPrefix(baseName, whiteoutMetaPrefix) {
+		// Other .wh..wh. entries (e.g. aufs hardlink bookkeeping) carry no
+		// meaning for OCI layers.
+		return nil
+	}
+
+	hidden := filepath.Join(dir, strings.TrimPrefix(baseName, whiteoutPrefix))
+	if hidden == filepath.Clean(destPath) || writes.written[hidden] {
+		return nil
+	}
+
+	if opts.overlayWhiteouts {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create parent directory for whiteout '%s': %w", hidden, err)
+		}
+		if err := os.RemoveAll(hidden); err != nil {
+			return fmt.Errorf("failed to replace '%s' with whiteout: %w", hidden, err)
+		}
+		if err := syscall.Mknod(hidden, syscall.S_IFCHR, 0); err != nil {
+			return fmt.Errorf("failed to create overlay whiteout '%s': %w", hidden, err)
+		}
+		return nil
+	}
+
+	if err := os.RemoveAll(hidden); err != nil {
+		return fmt.Errorf("failed to remove whiteout path '%s': %w", hidden, err)
+	}
+	return nil
+}
+
+// clearOpaqueDir removes everything below dir that lower layers put there,
+// keeping whatever the current layer has already extracted.
+func clearOpaqueDir(dir string, writes *layerWrites) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read opaque directory '%s': %w", dir, err)
+	}
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if !writes.touched[p] {
+			if err := os.RemoveAll(p); err != nil {
+				return fmt.Errorf("failed to clear '%s' from opaque directory: %w", p, err)
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if err := clearOpaqueDir(p, writes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinuxCapabilities lists the capabilities of the container process per
+// set, by name (CAP_CHOWN...), like the OCI runtime spec's
+// process.capabilities.
+type LinuxCapabilities struct {
+	Bounding    []string `json:"bounding,omitempty"`
+	Effective   []string `json:"effective,omitempty"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted,omitempty"`
+	Ambient     []string `json:"ambient,omitempty"`
+}
+
+var capabilityNumbers = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// The capabilities Docker grants containers by default.
+var defaultCapabilities = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FSETID", "CAP_FOWNER", "CAP_MKNOD",
+	"CAP_NET_RAW", "CAP_SETGID", "CAP_SETUID", "CAP_SETFCAP", "CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE", "CAP_SYS_CHROOT", "CAP_KILL", "CAP_AUDIT_WRITE",
+}
+
+// DefaultCapabilities returns the capability sets of a container started
+// without --cap-add or --cap-drop.
+func DefaultCapabilities() *LinuxCapabilities {
+	caps, _ := ContainerCapabilities(nil, nil)
+	return caps
+}
+
+// ContainerCapabilities returns the default capabilities with add and drop
+// applied. Names may omit the CAP_ prefix and are case-insensitive; "ALL"
+// stands for every capability. As with Docker, dropping ALL starts from an
+// empty set before adding and adding ALL starts from the full set before
+// dropping. The bounding, effective and permitted sets get the result,
+// inheritable and ambient stay empty.
+func ContainerCapabilities(add, drop []string) (*LinuxCapabilities, error) {
+	addSet, addAll, err := capabilitySet(add)
+	if err != nil {
+		return nil, err
+	}
+	dropSet, dropAll, err := capabilitySet(drop)
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	switch {
+	case addAll:
+		for name := range capabilityNumbers {
+			set[name] = true
+		}
+	case !dropAll:
+		for _, name := range defaultCapabilities {
+			set[name] = true
+		}
+	}
+	for name := range dropSet {
+		delete(set, name)
+	}
+	if !addAll {
+		for name := range addSet {
+			set[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &LinuxCapabilities{Bounding: names, Effective: names, Permitted: names}, nil
+}
+
+func capabilitySet(names []string) (map[string]bool, bool, error) {
+	set := make(map[string]bool)
+	all := false
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "ALL" {
+			all = true
+			continue
+		}
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		if _, ok := capabilityNumbers[name]; !ok {
+			return nil, false, fmt.Errorf("unknown capability '%s'", name)
+		}
+		set[name] = true
+	}
+	return set, all, nil
+}
+
+func capabilityMask(names []string) (uint64, error) {
+	var mask uint64
+	for _, name := range names {
+		n, ok := capabilityNumbers[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability '%s'", name)
+		}
+		mask |= 1 << uint(n)
+	}
+	return mask, nil
+}
+
+func lastCapability() int {
+	if content, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil {
+			return n
+		}
+	}
+	return unix.CAP_LAST_CAP
+}
+
+// ApplyCapabilities restricts the calling thread to caps. It must run on
+// the thread that will exec the container process (see runtime.LockOSThread)
+// since capabilities are per thread. Bounding set entries are dropped first,
+// as that needs CAP_SETPCAP, which the new sets may not keep.
+func ApplyCapabilities(caps *LinuxCapabilities) error {
+	bounding, err := capabilityMask(caps.Bounding)
+	if err != nil {
+		return err
+	}
+	effective, err := capabilityMask(caps.Effective)
+	if err != nil {
+		return err
+	}
+	permitted, err := capabilityMask(caps.Permitted)
+	if err != nil {
+		return err
+	}
+	inheritable, err := capabilityMask(caps.Inheritable)
+	if err != nil {
+		return err
+	}
+	ambient, err := capabilityMask(caps.Ambient)
+	if err != nil {
+		return err
+	}
+
+	for c := 0; c <= lastCapability(); c++ {
+		if bounding&(1<<uint(c)) != 0 {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", c, err)
+		}
+	}
+
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{
+		{Effective: uint32(effective), Permitted: uint32(permitted), Inheritable: uint32(inheritable)},
+		{Effective: uint32(effective >> 32), Permitted: uint32(permitted >> 32), Inheritable: uint32(inheritable >> 32)},
+	}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", err)
+	}
+	for c := 0; c <= lastCapability(); c++ {
+		if ambient&(1<<uint(c)) == 0 {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("failed to raise ambient capability %d: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// SetNoNewPrivileges keeps execve from granting privileges the process does
+// not already have, e.g. through setuid binaries or file capabilities.
+func SetNoNewPrivileges() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	return nil
+}
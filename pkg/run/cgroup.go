@@ -0,0 +1,253 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// Every container gets its own cgroup below this one, named by its ID.
+	cgroupParent = "container_runtime"
+	cpuPeriod    = 100000
+	// The kernel rejects cpu.max quotas below 1ms.
+	minCPUQuota = 1000
+)
+
+func (r *ResourcesConfig) Validate() error {
+	if r.Memory < 0 {
+		return fmt.Errorf("memory limit must be positive")
+	}
+	if r.MemorySwap != 0 {
+		if r.Memory == 0 {
+			return fmt.Errorf("a memory-swap limit requires a memory limit")
+		}
+		if r.MemorySwap != -1 && r.MemorySwap < r.Memory {
+			return fmt.Errorf("memory-swap limit (%d) must be at least the memory limit (%d)", r.MemorySwap, r.Memory)
+		}
+	}
+	if r.CPUs < 0 {
+		return fmt.Errorf("cpus must be positive")
+	}
+	if r.CPUs != 0 && r.CPUs*cpuPeriod < minCPUQuota {
+		return fmt.Errorf("cpus must be at least %.2f", float64(minCPUQuota)/cpuPeriod)
+	}
+	if r.CPUShares != 0 && (r.CPUShares < 2 || r.CPUShares > 262144) {
+		return fmt.Errorf("cpu-shares must be between 2 and 262144")
+	}
+	if r.PidsLimit < -1 {
+		return fmt.Errorf("pids-limit must be positive or -1")
+	}
+	if r.BlkioWeight != 0 && (r.BlkioWeight < 10 || r.BlkioWeight > 1000) {
+		return fmt.Errorf("blkio-weight must be between 10 and 1000")
+	}
+	return nil
+}
+
+// Empty reports whether no limit is set.
+func (r *ResourcesConfig) Empty() bool {
+	return r == nil || *r == ResourcesConfig{}
+}
+
+// Cgroup is a container's cgroup v2 directory.
+type Cgroup struct {
+	Path string
+}
+
+// CgroupPath returns where the cgroup of containerID lives.
+func CgroupPath(containerID string) string {
+	return filepath.Join(cgroupRoot, cgroupParent, containerID)
+}
+
+// CreateCgroup creates the cgroup of containerID and writes the limits in
+// resources to it. An existing cgroup left over from a previous run is
+// reused.
+func CreateCgroup(containerID string, resources *ResourcesConfig) (*Cgroup, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("resource limits require cgroup v2 mounted at %s", cgroupRoot)
+	}
+	if err := resources.Validate(); err != nil {
+		return nil, err
+	}
+
+	controllers := resources.controllers()
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup '%s': %w", parent, err)
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := enableControllers(dir, controllers); err != nil {
+			return nil, err
+		}
+	}
+
+	cg := &Cgroup{Path: CgroupPath(containerID)}
+	if err := os.Mkdir(cg.Path, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("failed to create cgroup '%s': %w", cg.Path, err)
+	}
+	if err := cg.setLimits(resources); err != nil {
+		cg.Remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (r *ResourcesConfig) controllers() []string {
+	var controllers []string
+	if r.Memory != 0 {
+		controllers = append(controllers, "memory")
+	}
+	if r.CPUs != 0 || r.CPUShares != 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if r.PidsLimit != 0 {
+		controllers = append(controllers, "pids")
+	}
+	if r.BlkioWeight != 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+// enableControllers makes controllers available to the children of dir.
+func enableControllers(dir string, controllers []string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read controllers of cgroup '%s': %w", dir, err)
+	}
+	enabled, _ := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	for _, controller := range controllers {
+		if !containsField(string(enabled), controller) {
+			if !containsField(string(available), controller) {
+				return fmt.Errorf("cgroup controller '%s' is not available in '%s'", controller, dir)
+			}
+			if err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+controller); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func containsField(s, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write '%s' to '%s': %w", value, path, err)
+	}
+	return nil
+}
+
+func (c *Cgroup) setLimits(r *ResourcesConfig) error {
+	if r.Memory != 0 {
+		if err := writeCgroupFile(c.Path, "memory.max", strconv.FormatInt(r.Memory, 10)); err != nil {
+			return err
+		}
+		// Docker's memory-swap counts memory too; cgroup v2 limits swap
+		// alone. Without a memory-swap limit swap is left as the kernel has
+		// it.
+		switch {
+		case r.MemorySwap == -1:
+			if err := writeCgroupFile(c.Path, "memory.swap.max", "max"); err != nil {
+				return err
+			}
+		case r.MemorySwap > 0:
+			if err := writeCgroupFile(c.Path, "memory.swap.max", strconv.FormatInt(r.MemorySwap-r.Memory, 10)); err != nil {
+				return err
+			}
+		}
+	}
+	if r.CPUs != 0 {
+		quota := int64(r.CPUs * cpuPeriod)
+		if err := writeCgroupFile(c.Path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return err
+		}
+	}
+	if r.CPUShares != 0 {
+		// The same mapping of cpu.shares onto cpu.weight (1-10000) as runc.
+		weight := 1 + ((r.CPUShares-2)*9999)/262142
+		if err := writeCgroupFile(c.Path, "cpu.weight", strconv.FormatUint(weight, 10)); err != nil {
+			return err
+		}
+	}
+	if r.PidsLimit != 0 {
+		limit := "max"
+		if r.PidsLimit > 0 {
+			limit = strconv.FormatInt(r.PidsLimit, 10)
+		}
+		if err := writeCgroupFile(c.Path, "pids.max", limit); err != nil {
+			return err
+		}
+	}
+	if r.BlkioWeight != 0 {
+		// BFQ takes the blkio weight as is; otherwise it is mapped onto
+		// io.weight (1-10000).
+		if _, err := os.Stat(filepath.Join(c.Path, "io.bfq.weight")); err == nil {
+			if err := writeCgroupFile(c.Path, "io.bfq.weight", strconv.Itoa(int(r.BlkioWeight))); err != nil {
+				return err
+			}
+		} else {
+			weight := 1 + (int(r.BlkioWeight)-10)*9999/990
+			if err := writeCgroupFile(c.Path, "io.weight", fmt.Sprintf("default %d", weight)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Apply makes cmd start inside the cgroup, so the container's processes are
+// limited from their first instruction on. The returned function closes the
+// cgroup directory once cmd has started.
+func (c *Cgroup) Apply(cmd *exec.Cmd) (func(), error) {
+	dir, err := os.Open(c.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cgroup '%s': %w", c.Path, err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return func() { dir.Close() }, nil
+}
+
+// Remove deletes the cgroup. It fails while processes are still in it.
+func (c *Cgroup) Remove() error {
+	if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cgroup '%s': %w", c.Path, err)
+	}
+	return nil
+}
+
+// OOMKills returns how many processes of the cgroup the kernel killed for
+// exceeding its memory limit.
+func (c *Cgroup) OOMKills() (int, error) {
+	path := filepath.Join(c.Path, "memory.events")
+	events, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if name, value, ok := strings.Cut(line, " "); ok && name == "oom_kill" {
+			return strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	return 0, nil
+}
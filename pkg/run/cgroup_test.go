@@ -0,0 +1,29 @@
+package run
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResourcesConfigValidateCPUs(t *testing.T) {
+	tests := []struct {
+		cpus    float64
+		wantErr string
+	}{
+		{cpus: 0},
+		{cpus: 0.01},
+		{cpus: 1.5},
+		{cpus: 0.005, wantErr: "at least 0.01"},
+		{cpus: -1, wantErr: "must be positive"},
+	}
+	for _, tt := range tests {
+		err := (&ResourcesConfig{CPUs: tt.cpus}).Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("Validate with cpus %g: %v", tt.cpus, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Validate with cpus %g error = %v, want one containing %q", tt.cpus, err, tt.wantErr)
+		}
+	}
+}
@@ -1,24 +1,60 @@
 package run
 
 type RootConfig struct {
-	Path     string `json:"path"`
-	ReadOnly bool   `json:"readonly"`
+	Path     string         `json:"path"`
+	ReadOnly bool           `json:"readonly"`
+	Overlay  *OverlayConfig `json:"overlay,omitempty"`
+}
+
+type OverlayConfig struct {
+	LowerDirs []string `json:"lowerDirs"`
+	UpperDir  string   `json:"upperDir"`
+	WorkDir   string   `json:"workDir"`
+	UserXattr bool     `json:"userXattr,omitempty"`
 }
 
 type ImageConfig struct {
-	OciVersion    string         `json:"ociVersion"`
-	ProcessConfig ProcessConfig  `json:"process"`
-	Hostname      string         `json:"hostname"`
-	MountsConfig  []MountsConfig `json:"mounts"`
-	Root          RootConfig     `json:"root"`
+	OciVersion    string           `json:"ociVersion"`
+	ProcessConfig ProcessConfig    `json:"process"`
+	Hostname      string           `json:"hostname"`
+	MountsConfig  []MountsConfig   `json:"mounts"`
+	Root          RootConfig       `json:"root"`
+	Image         *ImageRef        `json:"image,omitempty"`
+	Resources     *ResourcesConfig `json:"resources,omitempty"`
+	// Seccomp is the profile filtering the process's syscalls; nil means
+	// the default profile.
+	Seccomp *SeccompProfile `json:"seccomp,omitempty"`
+}
+
+// ImageRef records which image a container was created from. Digest is the
+// image's entry in the store (a manifest or an index), Manifest the
+// platform manifest that was actually used.
+type ImageRef struct {
+	Name     string `json:"name"`
+	Digest   string `json:"digest"`
+	Manifest string `json:"manifest"`
 }
 
 type ProcessConfig struct {
-	Terminal bool           `json:"terminal"`
-	User     map[string]int `json:"user"`
-	Args     []string       `json:"args"`
-	Env      []string       `json:"env"`
-	Cwd      string         `json:"cwd"`
+	Terminal bool     `json:"terminal"`
+	User     User     `json:"user"`
+	Args     []string `json:"args"`
+	Env      []string `json:"env"`
+	Cwd      string   `json:"cwd"`
+	// Capabilities left to the process; nil means the default set.
+	Capabilities    *LinuxCapabilities `json:"capabilities,omitempty"`
+	NoNewPrivileges bool               `json:"noNewPrivileges,omitempty"`
+}
+
+// User is who the container process runs as. Username keeps the user as the
+// image or --user gave it (nginx, www-data:www-data, 1000...); when set it is
+// resolved against the container's /etc/passwd and /etc/group as the process
+// starts, otherwise UID and GID are used as they are.
+type User struct {
+	UID            int    `json:"uid"`
+	GID            int    `json:"gid"`
+	AdditionalGids []int  `json:"additionalGids,omitempty"`
+	Username       string `json:"username,omitempty"`
 }
 
 type MountsConfig struct {
@@ -27,3 +63,21 @@ type MountsConfig struct {
 	Type        string   `json:"type"`
 	Options     []string `json:"options,omitempty"`
 }
+
+// ResourcesConfig holds the limits applied to a container's cgroup. Zero
+// values leave the corresponding limit unset.
+type ResourcesConfig struct {
+	// Memory is the memory limit in bytes.
+	Memory int64 `json:"memory,omitempty"`
+	// MemorySwap is the limit of memory plus swap in bytes, as with Docker;
+	// -1 allows unlimited swap.
+	MemorySwap int64 `json:"memorySwap,omitempty"`
+	// CPUs is the number of CPUs worth of time the container may use.
+	CPUs float64 `json:"cpus,omitempty"`
+	// CPUShares is the relative CPU weight in Docker's 2-262144 scale.
+	CPUShares uint64 `json:"cpuShares,omitempty"`
+	// PidsLimit caps the number of tasks; -1 means unlimited.
+	PidsLimit int64 `json:"pidsLimit,omitempty"`
+	// BlkioWeight is the relative block IO weight, 10-1000.
+	BlkioWeight uint16 `json:"blkioWeight,omitempty"`
+}
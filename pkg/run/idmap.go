@@ -0,0 +1,64 @@
+package run
+
+import "syscall"
+
+// Container IDs mapped when the runtime itself runs as root. The range covers
+// the users and groups regular images ship with (nginx, postgres, nobody...).
+const rootIDMapSize = 65536
+
+type IDMappings struct {
+	UIDs []syscall.SysProcIDMap
+	GIDs []syscall.SysProcIDMap
+}
+
+// ContainerIDMappings returns the user namespace mappings for a container
+// started by host uid/gid. Root maps the container IDs onto the same host
+// IDs; any other user can only map container root onto itself.
+func ContainerIDMappings(uid, gid int) IDMappings {
+	if uid == 0 {
+		return IDMappings{
+			UIDs: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: rootIDMapSize}},
+			GIDs: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: rootIDMapSize}},
+		}
+	}
+	return IDMappings{
+		UIDs: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GIDs: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+}
+
+func (m IDMappings) HostUID(containerUID int) (int, bool) {
+	return hostID(m.UIDs, containerUID)
+}
+
+func (m IDMappings) HostGID(containerGID int) (int, bool) {
+	return hostID(m.GIDs, containerGID)
+}
+
+func hostID(maps []syscall.SysProcIDMap, id int) (int, bool) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// ContainerUID is the inverse of HostUID: the container user a host file
+// owner appears as inside the container.
+func (m IDMappings) ContainerUID(hostUID int) (int, bool) {
+	return containerID(m.UIDs, hostUID)
+}
+
+func (m IDMappings) ContainerGID(hostGID int) (int, bool) {
+	return containerID(m.GIDs, hostGID)
+}
+
+func containerID(maps []syscall.SysProcIDMap, id int) (int, bool) {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID, true
+		}
+	}
+	return 0, false
+}
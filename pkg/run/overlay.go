@@ -0,0 +1,101 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const OverlayProbeArg = "overlay-probe"
+
+// Mount data is limited to a single page; deeper images must fall back to
+// copy mode.
+const maxOverlayOptionsLen = 4096 - 1
+
+func (o *OverlayConfig) MountOptions() string {
+	// overlayfs expects the topmost layer first in lowerdir.
+	lowers := make([]string, len(o.LowerDirs))
+	for i, dir := range o.LowerDirs {
+		lowers[len(o.LowerDirs)-1-i] = dir
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), o.UpperDir, o.WorkDir)
+	if o.UserXattr {
+		options += ",userxattr"
+	}
+	return options
+}
+
+func (o *OverlayConfig) Validate() error {
+	if len(o.LowerDirs) == 0 {
+		return fmt.Errorf("overlay rootfs needs at least one lower directory")
+	}
+	if options := o.MountOptions(); len(options) > maxOverlayOptionsLen {
+		return fmt.Errorf("overlay mount options are %d bytes, more than the %d allowed", len(options), maxOverlayOptionsLen)
+	}
+	return nil
+}
+
+func mountOverlay(target string, overlay *OverlayConfig) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create overlay mount point '%s': %w", target, err)
+	}
+	if err := syscall.Mount("overlay", target, "overlay", 0, overlay.MountOptions()); err != nil {
+		return fmt.Errorf("failed to mount overlay rootfs at '%s': %w", target, err)
+	}
+	return nil
+}
+
+// OverlaySupported checks whether the container child will be able to mount
+// overlayfs, by mounting a throwaway overlay inside the same kind of user and
+// mount namespaces the container gets. probeDir should be on the filesystem
+// that holds the layer snapshots.
+func OverlaySupported(probeDir string, userXattr bool, uid, gid int) error {
+	tmpDir, err := os.MkdirTemp(probeDir, ".overlay-probe-")
+	if err != nil {
+		return fmt.Errorf("failed to create overlay probe directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	absDir, err := filepath.Abs(tmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve overlay probe directory: %w", err)
+	}
+	overlay := &OverlayConfig{
+		LowerDirs: []string{filepath.Join(absDir, "lower")},
+		UpperDir:  filepath.Join(absDir, "upper"),
+		WorkDir:   filepath.Join(absDir, "work"),
+		UserXattr: userXattr,
+	}
+	for _, dir := range []string{overlay.LowerDirs[0], overlay.UpperDir, overlay.WorkDir, filepath.Join(absDir, "merged")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create overlay probe directory '%s': %w", dir, err)
+		}
+	}
+
+	idMaps := ContainerIDMappings(uid, gid)
+	probeArgs := []string{OverlayProbeArg, filepath.Join(absDir, "merged"), overlay.MountOptions()}
+	probeCmd := exec.Command("/proc/self/exe", probeArgs...)
+	probeCmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: idMaps.UIDs,
+		GidMappings: idMaps.GIDs,
+	}
+	output, err := probeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("overlay probe failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func HandleOverlayProbe(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%s requires a target and mount options", OverlayProbeArg)
+	}
+	if err := syscall.Mount("overlay", args[0], "overlay", 0, args[1]); err != nil {
+		return fmt.Errorf("mount overlay: %w", err)
+	}
+	return syscall.Unmount(args[0], syscall.MNT_DETACH)
+}
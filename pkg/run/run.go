@@ -9,6 +9,7 @@ import (
 )
 
 func ApplyNamespaces(cmd *exec.Cmd, uid, gid int) {
+	idMaps := ContainerIDMappings(uid, gid)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Cloneflags: syscall.CLONE_NEWUTS |
@@ -17,8 +18,11 @@ func ApplyNamespaces(cmd *exec.Cmd, uid, gid int) {
 			syscall.CLONE_NEWIPC |
 			syscall.CLONE_NEWUSER |
 			syscall.CLONE_NEWNET,
-		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
-		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+		UidMappings: idMaps.UIDs,
+		GidMappings: idMaps.GIDs,
+		// Only a privileged parent may allow setgroups, which the child
+		// needs for the supplementary groups of the container's user.
+		GidMappingsEnableSetgroups: uid == 0,
 	}
 
 }
@@ -62,6 +66,12 @@ func pivotRoot(newroot string) error {
 }
 
 func ApplyChroot(imageconf ImageConfig) error {
+	if imageconf.Root.Overlay != nil {
+		if err := mountOverlay(imageconf.Root.Path, imageconf.Root.Overlay); err != nil {
+			return fmt.Errorf("Error mounting overlay rootfs: %v", err)
+		}
+	}
+
 	if err := pivotRoot(imageconf.Root.Path); err != nil {
 		return fmt.Errorf("Error applying pivot_root: %v", err)
 	}
@@ -0,0 +1,413 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Seccomp actions, as named in Docker and OCI profiles.
+const (
+	SeccompActKill        = "SCMP_ACT_KILL"
+	SeccompActKillThread  = "SCMP_ACT_KILL_THREAD"
+	SeccompActKillProcess = "SCMP_ACT_KILL_PROCESS"
+	SeccompActTrap        = "SCMP_ACT_TRAP"
+	SeccompActErrno       = "SCMP_ACT_ERRNO"
+	SeccompActTrace       = "SCMP_ACT_TRACE"
+	SeccompActLog         = "SCMP_ACT_LOG"
+	SeccompActAllow       = "SCMP_ACT_ALLOW"
+)
+
+// SeccompProfile is a seccomp profile in the JSON format of Docker's
+// --security-opt seccomp=profile.json, which the OCI runtime spec's
+// linux.seccomp follows.
+type SeccompProfile struct {
+	DefaultAction string `json:"defaultAction"`
+	// DefaultErrnoRet is the errno of an SCMP_ACT_ERRNO default action,
+	// EPERM when unset.
+	DefaultErrnoRet *uint            `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	ArchMap         []SeccompArchMap `json:"archMap,omitempty"`
+	Syscalls        []SeccompSyscall `json:"syscalls,omitempty"`
+}
+
+type SeccompArchMap struct {
+	Architecture     string   `json:"architecture"`
+	SubArchitectures []string `json:"subArchitectures"`
+}
+
+// SeccompSyscall applies Action to the syscalls in Names when all of Args
+// match. Name is the single-syscall form of older Docker profiles.
+type SeccompSyscall struct {
+	Name     string         `json:"name,omitempty"`
+	Names    []string       `json:"names,omitempty"`
+	Action   string         `json:"action"`
+	ErrnoRet *uint          `json:"errnoRet,omitempty"`
+	Args     []SeccompArg   `json:"args,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+	Includes *SeccompFilter `json:"includes,omitempty"`
+	Excludes *SeccompFilter `json:"excludes,omitempty"`
+}
+
+// SeccompArg compares argument Index of a syscall with Value using Op
+// (SCMP_CMP_EQ, SCMP_CMP_NE, SCMP_CMP_LT, SCMP_CMP_LE, SCMP_CMP_GT,
+// SCMP_CMP_GE or SCMP_CMP_MASKED_EQ, where Value is the mask and ValueTwo
+// the expected result).
+type SeccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// SeccompFilter restricts a syscall rule to some architectures (Go or
+// SCMP_ARCH names), to containers with capabilities, or to kernels of at
+// least MinKernel. As in Docker, Includes requires every capability listed
+// while Excludes drops the rule if any of them is present.
+type SeccompFilter struct {
+	Arches    []string `json:"arches,omitempty"`
+	Caps      []string `json:"caps,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// UnconfinedSeccompProfile allows every syscall; no filter is installed for
+// it.
+func UnconfinedSeccompProfile() *SeccompProfile {
+	return &SeccompProfile{DefaultAction: SeccompActAllow}
+}
+
+// ReadSeccompProfile reads a JSON profile and checks that it compiles for
+// this machine.
+func ReadSeccompProfile(path string) (*SeccompProfile, error) {
+	profileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile '%s': %w", path, err)
+	}
+	var profile SeccompProfile
+	if err := json.Unmarshal(profileBytes, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse seccomp profile '%s': %w", path, err)
+	}
+	if _, err := CompileSeccomp(&profile, nil); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile '%s': %w", path, err)
+	}
+	return &profile, nil
+}
+
+// Offsets into struct seccomp_data.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// x32 syscalls on amd64 share the architecture of 64-bit ones but have this
+// bit set in their number.
+const x32SyscallBit = 0x40000000
+
+// Jumps to the end of a syscall's block are emitted with this offset and
+// resolved once the block is complete.
+const jumpNext = 0xff
+
+func bpfLoad(offset uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+}
+
+func bpfJump(op uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, Jt: jt, Jf: jf, K: k}
+}
+
+func bpfAnd(k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: k}
+}
+
+func bpfRet(k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: k}
+}
+
+// CompileSeccomp builds the BPF program enforcing profile for a process with
+// caps (nil when not known yet, which ignores capability conditions). Rules
+// are checked in order and the first matching one decides; syscalls that do
+// not exist on this architecture are skipped. Calls from any other
+// architecture kill the process. It returns nil for a profile that allows
+// everything.
+func CompileSeccomp(profile *SeccompProfile, caps *LinuxCapabilities) ([]unix.SockFilter, error) {
+	if nativeSeccompArch == "" {
+		return nil, fmt.Errorf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	if !profile.supportsNativeArch() {
+		return nil, fmt.Errorf("profile does not support architecture %s", nativeSeccompArch)
+	}
+	defaultRet, err := seccompReturn(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default action: %w", err)
+	}
+	if defaultRet == unix.SECCOMP_RET_ALLOW && len(profile.Syscalls) == 0 {
+		return nil, nil
+	}
+
+	var capSet map[string]bool
+	if caps != nil {
+		capSet = make(map[string]bool)
+		for _, name := range caps.Bounding {
+			capSet[name] = true
+		}
+	}
+
+	filter := []unix.SockFilter{
+		bpfLoad(seccompDataArch),
+		bpfJump(unix.BPF_JEQ, nativeAuditArch, 1, 0),
+		bpfRet(unix.SECCOMP_RET_KILL_PROCESS),
+		bpfLoad(seccompDataNr),
+	}
+	if nativeSeccompArch == "SCMP_ARCH_X86_64" {
+		filter = append(filter,
+			bpfJump(unix.BPF_JGE, x32SyscallBit, 0, 1),
+			bpfRet(unix.SECCOMP_RET_KILL_PROCESS),
+		)
+	}
+
+	// Argument checks leave the accumulator holding an argument, so the
+	// syscall number must be loaded again before the next comparison.
+	nrLoaded := true
+	for i, rule := range profile.Syscalls {
+		ret, err := seccompReturn(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid action of syscall rule %d: %w", i, err)
+		}
+		var args []unix.SockFilter
+		for _, arg := range rule.Args {
+			check, err := seccompArgCheck(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument of syscall rule %d: %w", i, err)
+			}
+			args = append(args, check...)
+		}
+		if !rule.applies(capSet) {
+			continue
+		}
+
+		names := rule.Names
+		if rule.Name != "" {
+			names = append([]string{rule.Name}, names...)
+		}
+		for _, name := range names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+			var block []unix.SockFilter
+			if !nrLoaded {
+				block = append(block, bpfLoad(seccompDataNr))
+			}
+			block = append(block, bpfJump(unix.BPF_JEQ, uint32(nr), 0, jumpNext))
+			block = append(block, args...)
+			block = append(block, bpfRet(ret))
+			for j := range block {
+				if block[j].Code&0x07 != unix.BPF_JMP {
+					continue
+				}
+				if block[j].Jt == jumpNext {
+					block[j].Jt = uint8(len(block) - j - 1)
+				}
+				if block[j].Jf == jumpNext {
+					block[j].Jf = uint8(len(block) - j - 1)
+				}
+			}
+			filter = append(filter, block...)
+			nrLoaded = len(args) == 0
+		}
+	}
+	filter = append(filter, bpfRet(defaultRet))
+
+	if len(filter) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("profile compiles to %d instructions, more than the kernel's limit of %d", len(filter), unix.BPF_MAXINSNS)
+	}
+	return filter, nil
+}
+
+func (p *SeccompProfile) supportsNativeArch() bool {
+	if len(p.Architectures) == 0 {
+		return true
+	}
+	for _, arch := range p.Architectures {
+		if arch == nativeSeccompArch {
+			return true
+		}
+		for _, m := range p.ArchMap {
+			if m.Architecture != arch {
+				continue
+			}
+			for _, sub := range m.SubArchitectures {
+				if sub == nativeSeccompArch {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func seccompReturn(action string, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		if *errnoRet > unix.SECCOMP_RET_DATA {
+			return 0, fmt.Errorf("errno %d out of range", *errnoRet)
+		}
+		errno = uint32(*errnoRet)
+	}
+	switch action {
+	case SeccompActKill, SeccompActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case SeccompActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case SeccompActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case SeccompActErrno:
+		return unix.SECCOMP_RET_ERRNO | errno, nil
+	case SeccompActTrace:
+		return unix.SECCOMP_RET_TRACE | errno, nil
+	case SeccompActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	case SeccompActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	}
+	return 0, fmt.Errorf("unsupported action '%s'", action)
+}
+
+// seccompArgCheck compares a 64-bit argument one 32-bit half at a time,
+// falling through when it matches and jumping to the end of the syscall's
+// block otherwise.
+func seccompArgCheck(arg SeccompArg) ([]unix.SockFilter, error) {
+	if arg.Index > 5 {
+		return nil, fmt.Errorf("argument index %d out of range", arg.Index)
+	}
+	lo := uint32(seccompDataArgs + 8*arg.Index)
+	hi := lo + 4
+	valueLo, valueHi := uint32(arg.Value), uint32(arg.Value>>32)
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []unix.SockFilter{
+			bpfLoad(hi), bpfJump(unix.BPF_JEQ, valueHi, 0, jumpNext),
+			bpfLoad(lo), bpfJump(unix.BPF_JEQ, valueLo, 0, jumpNext),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []unix.SockFilter{
+			bpfLoad(hi), bpfJump(unix.BPF_JEQ, valueHi, 0, 2),
+			bpfLoad(lo), bpfJump(unix.BPF_JEQ, valueLo, jumpNext, 0),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		return []unix.SockFilter{
+			bpfLoad(hi), bpfAnd(valueHi), bpfJump(unix.BPF_JEQ, uint32(arg.ValueTwo>>32), 0, jumpNext),
+			bpfLoad(lo), bpfAnd(valueLo), bpfJump(unix.BPF_JEQ, uint32(arg.ValueTwo), 0, jumpNext),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		last := bpfJump(unix.BPF_JGT, valueLo, 0, jumpNext)
+		if arg.Op == "SCMP_CMP_GE" {
+			last = bpfJump(unix.BPF_JGE, valueLo, 0, jumpNext)
+		}
+		return []unix.SockFilter{
+			bpfLoad(hi), bpfJump(unix.BPF_JGT, valueHi, 3, 0), bpfJump(unix.BPF_JEQ, valueHi, 0, jumpNext),
+			bpfLoad(lo), last,
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		last := bpfJump(unix.BPF_JGE, valueLo, jumpNext, 0)
+		if arg.Op == "SCMP_CMP_LE" {
+			last = bpfJump(unix.BPF_JGT, valueLo, jumpNext, 0)
+		}
+		return []unix.SockFilter{
+			bpfLoad(hi), bpfJump(unix.BPF_JGE, valueHi, 0, 3), bpfJump(unix.BPF_JEQ, valueHi, 0, jumpNext),
+			bpfLoad(lo), last,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported comparison '%s'", arg.Op)
+}
+
+// applies reports whether the rule's includes and excludes select it here.
+// Capability conditions are ignored when capSet is nil.
+func (s *SeccompSyscall) applies(capSet map[string]bool) bool {
+	if inc := s.Includes; inc != nil {
+		if len(inc.Arches) > 0 && !containsNativeArch(inc.Arches) {
+			return false
+		}
+		for _, c := range inc.Caps {
+			if capSet != nil && !capSet[c] {
+				return false
+			}
+		}
+		if inc.MinKernel != "" && !kernelAtLeast(inc.MinKernel) {
+			return false
+		}
+	}
+	if exc := s.Excludes; exc != nil {
+		if containsNativeArch(exc.Arches) {
+			return false
+		}
+		for _, c := range exc.Caps {
+			if capSet[c] {
+				return false
+			}
+		}
+		if exc.MinKernel != "" && kernelAtLeast(exc.MinKernel) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsNativeArch(arches []string) bool {
+	for _, arch := range arches {
+		if arch == runtime.GOARCH || arch == nativeSeccompArch {
+			return true
+		}
+	}
+	return false
+}
+
+// kernelAtLeast compares the running kernel's release with a version such
+// as "4.8".
+func kernelAtLeast(version string) bool {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return false
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+	want := strings.Split(version, ".")
+	have := strings.FieldsFunc(release, func(r rune) bool { return r < '0' || r > '9' })
+	for i, w := range want {
+		wn, _ := strconv.Atoi(w)
+		hn := 0
+		if i < len(have) {
+			hn, _ = strconv.Atoi(have[i])
+		}
+		if hn != wn {
+			return hn > wn
+		}
+	}
+	return true
+}
+
+// ApplySeccomp compiles profile for a process with caps and installs it on
+// the calling thread, which must be the one that execs the container process
+// (see runtime.LockOSThread). Unless no_new_privs is set this needs
+// CAP_SYS_ADMIN.
+func ApplySeccomp(profile *SeccompProfile, caps *LinuxCapabilities) error {
+	filter, err := CompileSeccomp(profile, caps)
+	if err != nil {
+		return fmt.Errorf("failed to compile seccomp profile: %w", err)
+	}
+	if filter == nil {
+		return nil
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return fmt.Errorf("failed to install seccomp filter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+
+package run
+
+// Seccomp profiles are only compiled for amd64 and arm64.
+const (
+	nativeAuditArch   = 0
+	nativeSeccompArch = ""
+)
+
+var syscallNumbers = map[string]int{}
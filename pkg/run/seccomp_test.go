@@ -0,0 +1,240 @@
+package run
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A seccomp filter cannot be removed once installed, so tests that install
+// one re-run themselves in a subprocess with this variable set.
+const seccompChildEnv = "SECCOMP_TEST_CHILD"
+
+func requireSeccomp(t *testing.T) {
+	t.Helper()
+	if nativeSeccompArch == "" {
+		t.Skipf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+}
+
+// runSeccompChild re-runs the calling test in a subprocess and fails if
+// any of its checks failed there.
+func runSeccompChild(t *testing.T) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), seccompChildEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("seccomp child failed: %v\n%s", err, out)
+	}
+}
+
+// installSeccomp locks the test goroutine to its thread, which the filter
+// applies to, and installs profile there.
+func installSeccomp(t *testing.T, profile *SeccompProfile, caps *LinuxCapabilities) {
+	t.Helper()
+	runtime.LockOSThread()
+	if err := SetNoNewPrivileges(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplySeccomp(profile, caps); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkErrno(t *testing.T, name string, want syscall.Errno, trap uintptr, args ...uintptr) {
+	t.Helper()
+	var a [3]uintptr
+	copy(a[:], args)
+	_, _, errno := unix.RawSyscall(trap, a[0], a[1], a[2])
+	if errno != want {
+		t.Errorf("%s: errno = %d (%v), want %d (%v)", name, errno, errno, want, want)
+	}
+}
+
+func checkAllowedSyscalls(t *testing.T) {
+	t.Helper()
+	if pid, _, errno := unix.RawSyscall(unix.SYS_GETPID, 0, 0, 0); errno != 0 || int(pid) != os.Getpid() {
+		t.Errorf("getpid = %d, %v, want %d", pid, errno, os.Getpid())
+	}
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		t.Errorf("uname: %v", err)
+	}
+	if _, err := os.ReadFile("/proc/self/status"); err != nil {
+		t.Errorf("reading /proc/self/status: %v", err)
+	}
+}
+
+func TestSeccompFilter(t *testing.T) {
+	requireSeccomp(t)
+	if os.Getenv(seccompChildEnv) == "" {
+		runSeccompChild(t)
+		return
+	}
+
+	eperm, enosys := uint(unix.EPERM), uint(unix.ENOSYS)
+	installSeccomp(t, &SeccompProfile{
+		DefaultAction: SeccompActAllow,
+		Syscalls: []SeccompSyscall{
+			{Names: []string{"getcwd"}, Action: SeccompActErrno, ErrnoRet: &eperm},
+			{
+				Names:    []string{"getpriority"},
+				Action:   SeccompActErrno,
+				ErrnoRet: &enosys,
+				Args:     []SeccompArg{{Index: 0, Value: unix.PRIO_PGRP, Op: "SCMP_CMP_EQ"}},
+			},
+		},
+	}, nil)
+
+	buf := make([]byte, 256)
+	checkErrno(t, "getcwd", unix.EPERM, unix.SYS_GETCWD, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	checkErrno(t, "getpriority(PRIO_PGRP)", unix.ENOSYS, unix.SYS_GETPRIORITY, unix.PRIO_PGRP, 0)
+	checkErrno(t, "getpriority(PRIO_PROCESS)", 0, unix.SYS_GETPRIORITY, unix.PRIO_PROCESS, 0)
+	checkAllowedSyscalls(t)
+}
+
+func TestDefaultSeccompProfile(t *testing.T) {
+	requireSeccomp(t)
+	if os.Getenv(seccompChildEnv) == "" {
+		runSeccompChild(t)
+		return
+	}
+
+	installSeccomp(t, DefaultSeccompProfile(), &LinuxCapabilities{})
+
+	// sysfs is not on the allowlist and would otherwise succeed.
+	checkErrno(t, "sysfs", unix.EPERM, unix.SYS_SYSFS, 3)
+	const addrNoRandomize = 0x0040000
+	checkErrno(t, "personality(ADDR_NO_RANDOMIZE)", unix.EPERM, unix.SYS_PERSONALITY, addrNoRandomize)
+	checkErrno(t, "personality(query)", 0, unix.SYS_PERSONALITY, 0xffffffff)
+	checkErrno(t, "clone3", unix.ENOSYS, unix.SYS_CLONE3)
+	checkErrno(t, "socket(AF_VSOCK)", unix.EPERM, unix.SYS_SOCKET, unix.AF_VSOCK, unix.SOCK_STREAM)
+	if _, err := os.Getwd(); err != nil {
+		t.Errorf("getcwd: %v", err)
+	}
+	checkAllowedSyscalls(t)
+}
+
+func TestReadSeccompProfile(t *testing.T) {
+	requireSeccomp(t)
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+		check   func(t *testing.T, p *SeccompProfile)
+	}{
+		{
+			name: "names, args and action",
+			json: `{"defaultAction": "SCMP_ACT_ERRNO", "defaultErrnoRet": 38, "syscalls": [
+				{"names": ["read", "write"], "action": "SCMP_ACT_ALLOW"},
+				{"name": "getcwd", "action": "SCMP_ACT_ERRNO", "errnoRet": 1},
+				{"names": ["socket"], "action": "SCMP_ACT_ALLOW",
+				 "args": [{"index": 0, "value": 40, "op": "SCMP_CMP_NE"}],
+				 "excludes": {"caps": ["CAP_NET_ADMIN"]}}]}`,
+			check: func(t *testing.T, p *SeccompProfile) {
+				if p.DefaultAction != SeccompActErrno || p.DefaultErrnoRet == nil || *p.DefaultErrnoRet != 38 {
+					t.Errorf("default action = %s %v, want SCMP_ACT_ERRNO 38", p.DefaultAction, p.DefaultErrnoRet)
+				}
+				if len(p.Syscalls) != 3 {
+					t.Fatalf("got %d syscall rules, want 3", len(p.Syscalls))
+				}
+				if got := p.Syscalls[0].Names; !reflect.DeepEqual(got, []string{"read", "write"}) {
+					t.Errorf("names = %v", got)
+				}
+				if s := p.Syscalls[1]; s.Name != "getcwd" || s.ErrnoRet == nil || *s.ErrnoRet != 1 {
+					t.Errorf("single-name rule = %+v", s)
+				}
+				want := []SeccompArg{{Index: 0, Value: 40, Op: "SCMP_CMP_NE"}}
+				if s := p.Syscalls[2]; !reflect.DeepEqual(s.Args, want) || s.Excludes == nil || s.Excludes.Caps[0] != "CAP_NET_ADMIN" {
+					t.Errorf("argument rule = %+v", s)
+				}
+			},
+		},
+		{
+			name: "native architecture",
+			json: `{"defaultAction": "SCMP_ACT_ALLOW", "architectures": ["` + nativeSeccompArch + `"]}`,
+		},
+		{
+			name: "native architecture through archMap",
+			json: `{"defaultAction": "SCMP_ACT_ALLOW", "architectures": ["SCMP_ARCH_DUMMY"],
+				"archMap": [{"architecture": "SCMP_ARCH_DUMMY", "subArchitectures": ["` + nativeSeccompArch + `"]}]}`,
+		},
+		{
+			name:    "other architectures only",
+			json:    `{"defaultAction": "SCMP_ACT_ALLOW", "architectures": ["SCMP_ARCH_S390X", "SCMP_ARCH_PPC64LE"]}`,
+			wantErr: "does not support architecture",
+		},
+		{
+			name: "unknown syscall names",
+			json: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [
+				{"names": ["no_such_syscall", "getcwd"], "action": "SCMP_ACT_ERRNO"}]}`,
+		},
+		{
+			name:    "unknown action",
+			json:    `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["getcwd"], "action": "SCMP_ACT_MAYBE"}]}`,
+			wantErr: "unsupported action",
+		},
+		{
+			name:    "unknown comparison",
+			json:    `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["getcwd"], "action": "SCMP_ACT_ERRNO", "args": [{"index": 0, "value": 1, "op": "SCMP_CMP_LIKE"}]}]}`,
+			wantErr: "unsupported comparison",
+		},
+		{
+			name:    "argument index out of range",
+			json:    `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["getcwd"], "action": "SCMP_ACT_ERRNO", "args": [{"index": 6, "value": 1, "op": "SCMP_CMP_EQ"}]}]}`,
+			wantErr: "out of range",
+		},
+		{
+			name:    "malformed JSON",
+			json:    `{"defaultAction": `,
+			wantErr: "failed to parse",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "profile.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			profile, err := ReadSeccompProfile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ReadSeccompProfile error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadSeccompProfile: %v", err)
+			}
+			if tt.check != nil {
+				tt.check(t, profile)
+			}
+		})
+	}
+}
+
+func TestCompileSeccompSkipsUnknownSyscalls(t *testing.T) {
+	requireSeccomp(t)
+	compile := func(names ...string) []unix.SockFilter {
+		t.Helper()
+		filter, err := CompileSeccomp(&SeccompProfile{
+			DefaultAction: SeccompActAllow,
+			Syscalls:      []SeccompSyscall{{Names: names, Action: SeccompActErrno}},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter
+	}
+	if got, want := compile("no_such_syscall", "getcwd", "also_missing"), compile("getcwd"); !reflect.DeepEqual(got, want) {
+		t.Errorf("unknown names changed the filter:\n got %v\nwant %v", got, want)
+	}
+}
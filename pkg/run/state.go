@@ -0,0 +1,135 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	StatusCreated = "created"
+	StatusRunning = "running"
+	StatusExited  = "exited"
+)
+
+// Why a container's process ended.
+const (
+	ExitNormal    = "normal"
+	ExitSignaled  = "signaled"
+	ExitOOMKilled = "oom-killed"
+)
+
+// ContainerState is what the runtime knows about a container's last run,
+// kept in state.json next to its config.json.
+type ContainerState struct {
+	Status     string     `json:"status"`
+	Pid        int        `json:"pid,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	ExitCode   int        `json:"exitCode"`
+	ExitReason string     `json:"exitReason,omitempty"`
+	Signal     string     `json:"signal,omitempty"`
+	// OOMKilled is set when the kernel killed a process of the container
+	// for exceeding its memory limit, even if that was not the main one.
+	OOMKilled bool `json:"oomKilled"`
+}
+
+func statePath(containerDir string) string {
+	return filepath.Join(containerDir, "state.json")
+}
+
+// ReadState returns the state of the container in containerDir. Containers
+// that never recorded one are reported as created. A running state whose
+// process is gone (the runtime itself was killed) is reported as exited with
+// no reason.
+func ReadState(containerDir string) (*ContainerState, error) {
+	stateBytes, err := os.ReadFile(statePath(containerDir))
+	if os.IsNotExist(err) {
+		return &ContainerState{Status: StatusCreated}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container state '%s': %w", statePath(containerDir), err)
+	}
+	var state ContainerState
+	if err := json.Unmarshal(stateBytes, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse container state '%s': %w", statePath(containerDir), err)
+	}
+	if state.Status == StatusRunning && syscall.Kill(state.Pid, 0) == syscall.ESRCH {
+		state.Status = StatusExited
+		state.Pid = 0
+	}
+	return &state, nil
+}
+
+func WriteState(containerDir string, state *ContainerState) error {
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal container state: %w", err)
+	}
+	tmpPath := statePath(containerDir) + ".tmp"
+	if err := os.WriteFile(tmpPath, stateBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write container state '%s': %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, statePath(containerDir)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write container state '%s': %w", statePath(containerDir), err)
+	}
+	return nil
+}
+
+// Started records that the container's process is running as pid.
+func (s *ContainerState) Started(pid int) {
+	now := time.Now().UTC()
+	*s = ContainerState{Status: StatusRunning, Pid: pid, StartedAt: &now}
+}
+
+// Exited records how the process ended from its wait status and the number
+// of OOM kills seen in the container's cgroup. Like Docker, a process killed
+// by a signal gets exit code 128 plus the signal number.
+func (s *ContainerState) Exited(ps *os.ProcessState, oomKills int) {
+	now := time.Now().UTC()
+	s.Status = StatusExited
+	s.Pid = 0
+	s.FinishedAt = &now
+	s.OOMKilled = oomKills > 0
+	s.ExitReason = ExitNormal
+	s.Signal = ""
+	s.ExitCode = ps.ExitCode()
+
+	status, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return
+	}
+	s.ExitCode = 128 + int(status.Signal())
+	s.Signal = unix.SignalName(status.Signal())
+	s.ExitReason = ExitSignaled
+	if s.OOMKilled && status.Signal() == syscall.SIGKILL {
+		s.ExitReason = ExitOOMKilled
+	}
+}
+
+// Describe summarizes the state for listings, e.g. "exited (137, oom-killed)".
+func (s *ContainerState) Describe() string {
+	switch s.Status {
+	case StatusRunning:
+		return fmt.Sprintf("running (pid %d)", s.Pid)
+	case StatusExited:
+		switch {
+		case s.ExitReason == "":
+			return "exited (unknown)"
+		case s.ExitReason == ExitSignaled:
+			return fmt.Sprintf("exited (%d, %s)", s.ExitCode, s.Signal)
+		case s.ExitReason == ExitOOMKilled:
+			return fmt.Sprintf("exited (%d, oom-killed)", s.ExitCode)
+		case s.OOMKilled:
+			return fmt.Sprintf("exited (%d, oom-kill in container)", s.ExitCode)
+		}
+		return fmt.Sprintf("exited (%d)", s.ExitCode)
+	}
+	return s.Status
+}
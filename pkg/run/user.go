@@ -0,0 +1,233 @@
+package run
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// ResolveUser resolves a user given as in Docker's --user or an image's
+// User (user, user:group, uid, uid:gid...) against the passwd and group
+// files below root. Names must exist there; numeric IDs are used as they
+// are, taking the primary group of a uid from passwd when it is listed.
+// Without an explicit group the user also gets the groups listing it as a
+// member.
+func ResolveUser(spec, root string) (User, error) {
+	user := User{Username: spec}
+	if spec == "" {
+		return user, nil
+	}
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+
+	users, err := readPasswd(filepath.Join(root, "etc", "passwd"))
+	if err != nil {
+		return user, err
+	}
+	var entry *passwdEntry
+	if uid, ok := parseID(userPart); ok {
+		user.UID = uid
+		for i := range users {
+			if users[i].uid == uid {
+				entry = &users[i]
+				break
+			}
+		}
+	} else {
+		for i := range users {
+			if users[i].name == userPart {
+				entry = &users[i]
+				break
+			}
+		}
+		if entry == nil {
+			return user, fmt.Errorf("unable to find user '%s': no matching entries in /etc/passwd", userPart)
+		}
+		user.UID = entry.uid
+	}
+	if entry != nil {
+		user.GID = entry.gid
+	}
+
+	var groups []groupEntry
+	if hasGroup || entry != nil {
+		if groups, err = readGroups(filepath.Join(root, "etc", "group")); err != nil {
+			return user, err
+		}
+	}
+	if hasGroup {
+		gid, ok := parseID(groupPart)
+		if !ok {
+			found := false
+			for _, g := range groups {
+				if g.name == groupPart {
+					gid, found = g.gid, true
+					break
+				}
+			}
+			if !found {
+				return user, fmt.Errorf("unable to find group '%s': no matching entries in /etc/group", groupPart)
+			}
+		}
+		user.GID = gid
+		return user, nil
+	}
+	if entry != nil {
+		for _, g := range groups {
+			if g.gid == user.GID {
+				continue
+			}
+			for _, member := range g.members {
+				if member == entry.name {
+					user.AdditionalGids = append(user.AdditionalGids, g.gid)
+					break
+				}
+			}
+		}
+	}
+	return user, nil
+}
+
+func parseID(s string) (int, bool) {
+	// (uid_t)-1 is not a valid ID.
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 1<<32-1 {
+		return 0, false
+	}
+	return int(id), true
+}
+
+// readColonFile returns the fields of each entry of a passwd-style file. A
+// missing file has no entries.
+func readColonFile(path string, minFields int) ([][]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < minFields {
+			continue
+		}
+		entries = append(entries, fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	return entries, nil
+}
+
+func readPasswd(path string) ([]passwdEntry, error) {
+	lines, err := readColonFile(path, 4)
+	if err != nil {
+		return nil, err
+	}
+	var users []passwdEntry
+	for _, fields := range lines {
+		uid, uidOK := parseID(fields[2])
+		gid, gidOK := parseID(fields[3])
+		if uidOK && gidOK {
+			users = append(users, passwdEntry{name: fields[0], uid: uid, gid: gid})
+		}
+	}
+	return users, nil
+}
+
+func readGroups(path string) ([]groupEntry, error) {
+	lines, err := readColonFile(path, 3)
+	if err != nil {
+		return nil, err
+	}
+	var groups []groupEntry
+	for _, fields := range lines {
+		gid, ok := parseID(fields[2])
+		if !ok {
+			continue
+		}
+		group := groupEntry{name: fields[0], gid: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			group.members = strings.Split(fields[3], ",")
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// SetUser switches the calling thread to user. Like capabilities it only
+// affects this thread, which must be the one that execs the container
+// process. The thread keeps its capabilities so ApplyCapabilities can still
+// restrict them afterwards; exec clears them anyway for a user other than
+// root.
+func SetUser(user User) error {
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set keepcaps: %w", err)
+	}
+
+	// User namespaces set up by an unprivileged runtime deny setgroups.
+	setgroups, _ := os.ReadFile("/proc/self/setgroups")
+	if strings.TrimSpace(string(setgroups)) != "deny" {
+		gids := make([]uint32, len(user.AdditionalGids))
+		for i, gid := range user.AdditionalGids {
+			gids[i] = uint32(gid)
+		}
+		var ptr uintptr
+		if len(gids) > 0 {
+			ptr = uintptr(unsafe.Pointer(&gids[0]))
+		}
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETGROUPS, uintptr(len(gids)), ptr, 0); errno != 0 {
+			return fmt.Errorf("failed to set supplementary groups %v: %w", user.AdditionalGids, errno)
+		}
+	} else if len(user.AdditionalGids) > 0 {
+		fmt.Fprintf(os.Stderr, "warning: supplementary groups %v not set, setgroups is denied in this user namespace\n", user.AdditionalGids)
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETGID, uintptr(user.GID), 0, 0); errno != 0 {
+		return fmt.Errorf("failed to set gid %d: %w", user.GID, errno)
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETUID, uintptr(user.UID), 0, 0); errno != 0 {
+		return fmt.Errorf("failed to set uid %d: %w", user.UID, errno)
+	}
+
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear keepcaps: %w", err)
+	}
+	// Changing the uid away from 0 clears the effective set even with
+	// keepcaps; raise it again from the permitted set.
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to get capabilities: %w", err)
+	}
+	data[0].Effective, data[1].Effective = data[0].Permitted, data[1].Permitted
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+	return nil
+}
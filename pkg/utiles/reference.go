@@ -0,0 +1,114 @@
+package utiles
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	DefaultRegistry  = "docker.io"
+	DefaultNamespace = "library"
+	DefaultTag       = "latest"
+)
+
+var (
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	registryRegexp      = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*|\[[0-9a-fA-F:]+\])(?::[0-9]+)?$`)
+)
+
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+func ParseReference(name string) (Reference, error) {
+	if name == "" {
+		return Reference{}, fmt.Errorf("empty image reference")
+	}
+
+	var ref Reference
+	remainder := name
+
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		dgst, err := digest.Parse(remainder[i+1:])
+		if err != nil {
+			return Reference{}, fmt.Errorf("invalid digest in reference '%s': %w", name, err)
+		}
+		ref.Digest = dgst
+		remainder = remainder[:i]
+	}
+
+	// A colon after the last slash separates the tag; earlier colons belong
+	// to a registry port (localhost:5000/app).
+	lastSlash := strings.LastIndex(remainder, "/")
+	if i := strings.LastIndex(remainder, ":"); i > lastSlash {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid tag '%s' in reference '%s'", ref.Tag, name)
+		}
+	}
+
+	ref.Registry = DefaultRegistry
+	if i := strings.Index(remainder, "/"); i >= 0 {
+		first := remainder[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first {
+			ref.Registry = first
+			remainder = remainder[i+1:]
+		}
+	}
+	if ref.Registry == "index.docker.io" || ref.Registry == "registry-1.docker.io" {
+		ref.Registry = DefaultRegistry
+	}
+	if !registryRegexp.MatchString(ref.Registry) {
+		return Reference{}, fmt.Errorf("invalid registry '%s' in reference '%s'", ref.Registry, name)
+	}
+
+	if ref.Registry == DefaultRegistry && !strings.Contains(remainder, "/") {
+		remainder = DefaultNamespace + "/" + remainder
+	}
+	if remainder == "" {
+		return Reference{}, fmt.Errorf("missing repository in reference '%s'", name)
+	}
+	for _, component := range strings.Split(remainder, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return Reference{}, fmt.Errorf("invalid repository name '%s' in reference '%s'", remainder, name)
+		}
+	}
+	ref.Repository = remainder
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+// Identifier is what the registry is asked for: the digest when the
+// reference is pinned, otherwise the tag.
+func (r Reference) Identifier() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}